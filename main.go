@@ -5,16 +5,26 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/retawsolit/WeMeet-recorder/helpers"
 	"github.com/retawsolit/WeMeet-recorder/pkg/config"
 	"github.com/retawsolit/WeMeet-recorder/pkg/controllers"
+	"github.com/retawsolit/WeMeet-recorder/pkg/outbox"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tracing"
 	"github.com/retawsolit/WeMeet-recorder/version"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v3"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
+// outboxFlushTimeout is the min time to deliver the pending notifications on shutdown
+const outboxFlushTimeout = 30 * time.Second
+
 func main() {
 	cli.VersionPrinter = func(c *cli.Command) {
 		fmt.Printf("%s\n", c.Version)
@@ -32,6 +42,29 @@ func main() {
 				Value:       "config.yaml",
 			},
 		},
+		Commands: []*cli.Command{
+			{
+				Name:  "outbox",
+				Usage: "Inspect the notifications for WeMeet server",
+				Commands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "List the pending notifications",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "delivered",
+								Usage: "List the delivered notifications instead",
+							},
+							&cli.BoolFlag{
+								Name:  "failed",
+								Usage: "List the notifications rejected by the server instead",
+							},
+						},
+						Action: listOutbox,
+					},
+				},
+			},
+		},
 		Action:  startServer,
 		Version: version.Version,
 	}
@@ -54,6 +87,10 @@ func startServer(ctx context.Context, c *cli.Command) error {
 	if err != nil {
 		logrus.Fatalln(err)
 	}
+	shutdownTracing, err := tracing.Init(config.GetConfig())
+	if err != nil {
+		logrus.Fatalln(err)
+	}
 
 	// start services
 	rc := controllers.NewRecorderController()
@@ -66,9 +103,90 @@ func startServer(ctx context.Context, c *cli.Command) error {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-sigChan
 
+	// bounds the delivery of the pending notifications
+	shutdownCtx, cancelShutdown := context.WithTimeout(ctx, outboxFlushTimeout)
+	defer cancelShutdown()
+
+	if sig == syscall.SIGTERM {
+		// let the running tasks finish, a second signal will force the shutdown
+		logrus.Infoln("drain requested by signal", sig)
+		drainTimeout := time.Duration(config.GetConfig().Recorder.DrainTimeout) * time.Second
+		drainCtx, cancel := context.WithTimeout(ctx, drainTimeout)
+		defer cancel()
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			rc.Drain(drainCtx)
+		}()
+
+		select {
+		case <-drained:
+			if deadline, _ := drainCtx.Deadline(); time.Until(deadline) > outboxFlushTimeout {
+				// the remaining of the drain timeout can be used for notifications
+				shutdownCtx = drainCtx
+			}
+		case sig = <-sigChan:
+			logrus.Infoln("forcing shutdown by signal", sig)
+		}
+	}
+
 	logrus.Infoln("exit requested, shutting down signal", sig)
 	// close all the remaining task
-	rc.CallEndToAll()
+	rc.CallEndToAll(shutdownCtx)
+
+	// flush the remaining spans
+	tracingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(tracingCtx); err != nil {
+		logrus.Errorln(err)
+	}
 
 	return nil
 }
+
+func listOutbox(ctx context.Context, c *cli.Command) error {
+	appCnf, err := helpers.ReadYamlConfigFile(c.String("config"))
+	if err != nil {
+		return err
+	}
+	// to resolve state_dir
+	config.New(appCnf)
+
+	box := outbox.Pending
+	switch {
+	case c.Bool("delivered"):
+		box = outbox.Delivered
+	case c.Bool("failed"):
+		box = outbox.Failed
+	}
+	msgs, err := outbox.List(path.Join(config.GetConfig().Recorder.StateDir, "outbox"), box)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	switch box {
+	case outbox.Delivered:
+		_, _ = fmt.Fprintln(w, "ID\tKEY\tTASK\tATTEMPTS\tSTATUS\tDELIVERED AT")
+	case outbox.Failed:
+		_, _ = fmt.Fprintln(w, "ID\tKEY\tTASK\tATTEMPTS\tSTATUS\tFAILED AT\tERROR")
+	default:
+		_, _ = fmt.Fprintln(w, "ID\tKEY\tTASK\tATTEMPTS\tNEXT ATTEMPT\tLAST ERROR")
+	}
+	for _, m := range msgs {
+		req := new(wemeet.RecorderToWeMeet)
+		task := "unknown"
+		if err := protojson.Unmarshal(m.Payload, req); err == nil {
+			task = req.Task.String()
+		}
+		switch {
+		case box == outbox.Delivered && m.DeliveredAt != nil:
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", m.Id, m.Key, task, m.Attempts, m.StatusCode, m.DeliveredAt.Local().Format(time.RFC3339))
+		case box == outbox.Failed && m.FailedAt != nil:
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", m.Id, m.Key, task, m.Attempts, m.StatusCode, m.FailedAt.Local().Format(time.RFC3339), m.LastError)
+		default:
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", m.Id, m.Key, task, m.Attempts, m.NextAttemptAt.Local().Format(time.RFC3339), m.LastError)
+		}
+	}
+	return w.Flush()
+}
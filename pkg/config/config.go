@@ -9,6 +9,7 @@ import (
 
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -23,6 +24,35 @@ type AppConfig struct {
 	FfmpegSettings *FfmpegSettings `yaml:"ffmpeg_settings"`
 	NatsInfo       NatsInfo        `yaml:"nats_info"`
 	WeMeetInfo     WeMeetInfo      `yaml:"WeMeet_info"`
+	HlsServer      HlsServerInfo   `yaml:"hls_server"`
+	HttpServer     HttpServerInfo  `yaml:"http_server"`
+	Tracing        TracingInfo     `yaml:"tracing"`
+}
+
+// TracingInfo will export the spans of every task to an otlp collector over http
+type TracingInfo struct {
+	Enabled bool `yaml:"enabled"`
+	// host:port of the collector
+	Endpoint string `yaml:"endpoint"`
+	UrlPath  string `yaml:"url_path"`
+	// default true, plain http
+	Insecure    *bool   `yaml:"insecure"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// HttpServerInfo is the local http server for health checks & inspection
+type HttpServerInfo struct {
+	Enabled       bool   `yaml:"enabled"`
+	ListenAddress string `yaml:"listen_address"`
+}
+
+// HlsServerInfo is the built-in http server for local hls live outputs
+type HlsServerInfo struct {
+	Enabled       bool   `yaml:"enabled"`
+	ListenAddress string `yaml:"listen_address"`
+	// playlists & segments will be written here
+	WorkDir string `yaml:"work_dir"`
 }
 
 type RecorderInfo struct {
@@ -36,6 +66,94 @@ type RecorderInfo struct {
 	XvfbDpi               uint64             `yaml:"xvfb_dpi"`
 	CopyToPath            CopyToPathSettings `yaml:"copy_to_path"`
 	PostProcessingScripts []string           `yaml:"post_processing_scripts"`
+	Validation            ValidationSettings `yaml:"validation"`
+	Admission             AdmissionSettings  `yaml:"admission"`
+	SegmentedRecording    SegmentedSettings  `yaml:"segmented_recording"`
+	FfmpegRestart         FfmpegRestart      `yaml:"ffmpeg_restart"`
+	FfmpegStall           FfmpegStall        `yaml:"ffmpeg_stall"`
+	MaxChromeRecoveries   int                `yaml:"max_chrome_recoveries"`
+	ShareBrowserSession   bool               `yaml:"share_browser_session"`
+	AudioOnly             AudioOnlySettings  `yaml:"audio_only"`
+	// full_screen or media_only
+	RecordingVariant string `yaml:"recording_variant"`
+	// will be injected in the page for media_only variant
+	MediaOnlyCss string `yaml:"media_only_css"`
+	// state of the running tasks will be kept here to recover after a crash
+	StateDir string         `yaml:"state_dir"`
+	Outbox   OutboxSettings `yaml:"outbox"`
+	// in seconds, max time to wait for running tasks during drain
+	DrainTimeout uint64 `yaml:"drain_timeout"`
+	// hosts allowed in rtmp_url of the tasks, empty will allow any
+	AllowedLiveHosts []string `yaml:"allowed_live_hosts"`
+	// key is the room id
+	RoomOverrides map[string]RoomOverride `yaml:"room_overrides"`
+	// consecutive retries of a fan-out destination before it's marked as failed,
+	// -1 is unlimited. Default will be used if it's not set
+	MaxDestinationRetries *int `yaml:"max_destination_retries"`
+}
+
+// RoomOverride will be applied for the tasks of a particular room
+type RoomOverride struct {
+	RtmpDestinations []string `yaml:"rtmp_destinations"`
+	AudioOnly        *bool    `yaml:"audio_only"`
+	RecordingVariant *string  `yaml:"recording_variant"`
+}
+
+// AudioOnlySettings will record only the audio of the room,
+// chrome will join on a minimal virtual display without screen capture
+type AudioOnlySettings struct {
+	Enabled bool `yaml:"enabled"`
+	// m4a (aac) or ogg (opus)
+	Format string `yaml:"format"`
+}
+
+// FfmpegRestart is the retry policy used when ffmpeg exits unexpectedly.
+// Backoff will be doubled after every restart up to MaxBackoff.
+type FfmpegRestart struct {
+	MaxRestarts int `yaml:"max_restarts"`
+	// in seconds
+	Backoff    uint64 `yaml:"backoff"`
+	MaxBackoff uint64 `yaml:"max_backoff"`
+}
+
+// ValidationSettings are the expectations checked by probing the final file of a recording
+type ValidationSettings struct {
+	// in seconds, 0 will disable the check. Default will be used if it's not set
+	MinDuration *uint64 `yaml:"min_duration"`
+}
+
+// FfmpegStall decides when ffmpeg will be treated as stalled,
+// using the output time reported by its progress
+type FfmpegStall struct {
+	// in seconds, without any advance of the output time, 0 will disable the check.
+	// Default will be used if it's not set
+	Timeout *uint64 `yaml:"timeout"`
+	// kill the stalled ffmpeg, so that it will be restarted by ffmpeg_restart
+	Restart bool `yaml:"restart"`
+}
+
+// OutboxSettings for the delivery of notifications to WeMeet server
+type OutboxSettings struct {
+	// in seconds, failed notifications will be retried forever with backoff up to this
+	MaxBackoff uint64 `yaml:"max_backoff"`
+	// in hours, delivered notifications will be kept for inspection
+	KeepDelivered uint64 `yaml:"keep_delivered"`
+}
+
+// AdmissionSettings are optional host thresholds checked before accepting a new task.
+// Zero value disables the particular check.
+type AdmissionSettings struct {
+	MaxCpuLoad      float64 `yaml:"max_cpu_load"`
+	MinFreeMemoryMb uint64  `yaml:"min_free_memory_mb"`
+	MinFreeDiskMb   uint64  `yaml:"min_free_disk_mb"`
+}
+
+// SegmentedSettings will make ffmpeg write the recording as a number of
+// independent segments, so that a crash will only damage the last one
+type SegmentedSettings struct {
+	Enabled bool `yaml:"enabled"`
+	// segment length in seconds
+	SegmentDuration uint64 `yaml:"segment_duration"`
 }
 
 type CopyToPathSettings struct {
@@ -49,12 +167,38 @@ type LogSettings struct {
 	MaxBackups int     `yaml:"max_backups"`
 	MaxAge     int     `yaml:"max_age"`
 	LogLevel   *string `yaml:"log_level"`
+	// optional, a separate file for every recording
+	RecordingLogs RecordingLogSettings `yaml:"recording_logs"`
+}
+
+// RecordingLogSettings will write the log entries of every task to its own file as well.
+// The file will be placed next to the recording, or in Dir if set.
+type RecordingLogSettings struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	// in megabytes, the file will be rotated after this
+	MaxSize int `yaml:"max_size"`
+	// in days, older files will be removed from Dir
+	MaxAge int `yaml:"max_age"`
 }
 
 type FfmpegSettings struct {
-	Recording     FfmpegOptions `yaml:"recording"`
-	PostRecording FfmpegOptions `yaml:"post_recording"`
-	Rtmp          FfmpegOptions `yaml:"rtmp"`
+	Recording          FfmpegOptions `yaml:"recording"`
+	SegmentedRecording FfmpegOptions `yaml:"segmented_recording"`
+	PostRecording      FfmpegOptions `yaml:"post_recording"`
+	Rtmp               FfmpegOptions `yaml:"rtmp"`
+	AudioOnlyRecording FfmpegOptions `yaml:"audio_only_recording"`
+	// selected by the scheme of the live output url
+	Protocols FfmpegProtocolOptions `yaml:"protocols"`
+}
+
+// FfmpegProtocolOptions will be placed right before the output url,
+// so these will override the muxer (-f) set in post_input
+type FfmpegProtocolOptions struct {
+	Rtmp  string `yaml:"rtmp"`
+	Rtmps string `yaml:"rtmps"`
+	Srt   string `yaml:"srt"`
+	Hls   string `yaml:"hls"`
 }
 
 type FfmpegOptions struct {
@@ -76,8 +220,49 @@ type NatsInfo struct {
 }
 
 type NatsInfoRecorder struct {
-	RecorderChannel string `yaml:"recorder_channel"`
-	RecorderInfoKv  string `yaml:"recorder_info_kv"`
+	RecorderChannel string         `yaml:"recorder_channel"`
+	RecorderInfoKv  string         `yaml:"recorder_info_kv"`
+	TaskStream      TaskStreamInfo `yaml:"task_stream"`
+	TaskAuth        TaskAuthInfo   `yaml:"task_auth"`
+	Events          EventsInfo     `yaml:"events"`
+	Admin           AdminInfo      `yaml:"admin"`
+}
+
+// AdminInfo will enable the request/reply api on <subject>.<recorder id>
+type AdminInfo struct {
+	Enabled bool   `yaml:"enabled"`
+	Subject string `yaml:"subject"`
+}
+
+// EventsInfo will publish the lifecycle events of the recordings in a JetStream stream
+// with subject <subject_prefix>.<recorder id>.<room id>.<event type>
+type EventsInfo struct {
+	Enabled       bool   `yaml:"enabled"`
+	Stream        string `yaml:"stream"`
+	SubjectPrefix string `yaml:"subject_prefix"`
+	// in hours
+	MaxAge uint64 `yaml:"max_age"`
+}
+
+// TaskAuthInfo decides how the signature of the tasks will be checked.
+// Mode can be off, permissive (verify & count but still accept) or enforce.
+type TaskAuthInfo struct {
+	Mode string `yaml:"mode"`
+	// in seconds, signed tasks older than this will be rejected
+	MaxAge uint64 `yaml:"max_age"`
+}
+
+// TaskStreamInfo will store the tasks of recorder_channel in a JetStream stream,
+// so that tasks published while this recorder was disconnected won't be lost.
+// Every recorder will use its own durable consumer.
+type TaskStreamInfo struct {
+	Enabled bool   `yaml:"enabled"`
+	Name    string `yaml:"name"`
+	// in seconds, message will be redelivered if not acked within this time
+	AckWait    uint64 `yaml:"ack_wait"`
+	MaxDeliver int    `yaml:"max_deliver"`
+	// in seconds, older start tasks will be acked without starting
+	MaxTaskAge uint64 `yaml:"max_task_age"`
 }
 
 var appCnf *AppConfig
@@ -109,6 +294,115 @@ func (a *AppConfig) setDefaultConfig() {
 	if a.Recorder.XvfbDpi == 0 {
 		a.Recorder.XvfbDpi = 96
 	}
+	if a.Recorder.SegmentedRecording.SegmentDuration == 0 {
+		a.Recorder.SegmentedRecording.SegmentDuration = 60
+	}
+	if a.Recorder.FfmpegRestart.Backoff == 0 {
+		a.Recorder.FfmpegRestart.Backoff = 2
+	}
+	if a.Recorder.FfmpegRestart.MaxBackoff == 0 {
+		a.Recorder.FfmpegRestart.MaxBackoff = 30
+	}
+	if a.Recorder.Validation.MinDuration == nil {
+		minDuration := uint64(1)
+		a.Recorder.Validation.MinDuration = &minDuration
+	}
+	if a.Recorder.FfmpegStall.Timeout == nil {
+		timeout := uint64(30)
+		a.Recorder.FfmpegStall.Timeout = &timeout
+	}
+
+	a.Recorder.AudioOnly.Format = strings.ToLower(a.Recorder.AudioOnly.Format)
+	if a.Recorder.AudioOnly.Format != "ogg" {
+		a.Recorder.AudioOnly.Format = "m4a"
+	}
+	if a.Recorder.RecordingVariant == "" {
+		a.Recorder.RecordingVariant = "full_screen"
+	}
+	if a.Recorder.MediaOnlyCss == "" {
+		a.Recorder.MediaOnlyCss = "header, footer, #main-header, #main-footer, .side-panel, .participants-wrapper, .messageModule-wrapper, .notification { display: none !important; } #main-area { width: 100vw !important; height: 100vh !important; margin: 0 !important; }"
+	}
+	ts := &a.NatsInfo.Recorder.TaskStream
+	if ts.Name == "" {
+		ts.Name = "recorder-tasks"
+	}
+	if ts.AckWait == 0 {
+		ts.AckWait = 30
+	}
+	if ts.MaxDeliver == 0 {
+		ts.MaxDeliver = 5
+	}
+	if ts.MaxTaskAge == 0 {
+		ts.MaxTaskAge = 120
+	}
+	a.NatsInfo.Recorder.Admin.Subject = strings.Trim(a.NatsInfo.Recorder.Admin.Subject, ".")
+	if a.NatsInfo.Recorder.Admin.Subject == "" {
+		a.NatsInfo.Recorder.Admin.Subject = "recorderAdmin"
+	}
+	ev := &a.NatsInfo.Recorder.Events
+	if ev.Stream == "" {
+		ev.Stream = "recorder-events"
+	}
+	ev.SubjectPrefix = strings.Trim(ev.SubjectPrefix, ".")
+	if ev.SubjectPrefix == "" {
+		ev.SubjectPrefix = "wemeet.recorder.events"
+	}
+	if ev.MaxAge == 0 {
+		ev.MaxAge = 72
+	}
+
+	if a.Recorder.StateDir == "" {
+		a.Recorder.StateDir = "./state"
+	}
+	if strings.HasPrefix(a.Recorder.StateDir, "./") {
+		a.Recorder.StateDir = filepath.Join(a.RootWorkingDir, a.Recorder.StateDir)
+	}
+	if a.Recorder.Outbox.MaxBackoff == 0 {
+		a.Recorder.Outbox.MaxBackoff = 300
+	}
+	if a.Recorder.Outbox.KeepDelivered == 0 {
+		a.Recorder.Outbox.KeepDelivered = 72
+	}
+	if a.Recorder.MaxDestinationRetries == nil {
+		maxRetries := 10
+		a.Recorder.MaxDestinationRetries = &maxRetries
+	}
+	if a.Recorder.DrainTimeout == 0 {
+		a.Recorder.DrainTimeout = 3600
+	}
+	for i, h := range a.Recorder.AllowedLiveHosts {
+		a.Recorder.AllowedLiveHosts[i] = strings.ToLower(h)
+	}
+	ta := &a.NatsInfo.Recorder.TaskAuth
+	ta.Mode = strings.ToLower(ta.Mode)
+	if ta.Mode != "permissive" && ta.Mode != "enforce" {
+		ta.Mode = "off"
+	}
+	if ta.MaxAge == 0 {
+		ta.MaxAge = 30
+	}
+
+	if a.HlsServer.ListenAddress == "" {
+		a.HlsServer.ListenAddress = "127.0.0.1:8090"
+	}
+	if a.Tracing.Endpoint == "" {
+		a.Tracing.Endpoint = "127.0.0.1:4318"
+	}
+	if a.Tracing.ServiceName == "" {
+		a.Tracing.ServiceName = "wemeet-recorder"
+	}
+	if a.Tracing.SampleRatio <= 0 || a.Tracing.SampleRatio > 1 {
+		a.Tracing.SampleRatio = 1
+	}
+	if a.HttpServer.ListenAddress == "" {
+		a.HttpServer.ListenAddress = "127.0.0.1:8091"
+	}
+	if a.HlsServer.WorkDir == "" {
+		a.HlsServer.WorkDir = "./hls_live"
+	}
+	if strings.HasPrefix(a.HlsServer.WorkDir, "./") {
+		a.HlsServer.WorkDir = filepath.Join(a.RootWorkingDir, a.HlsServer.WorkDir)
+	}
 
 	if a.FfmpegSettings == nil {
 		commonPostInput := "-c:v libx264 -x264-params keyint=120:scenecut=0 -preset veryfast -crf 23 -c:a aac -af highpass=f=200,lowpass=f=2000,afftdn -async 1 -movflags frag_keyframe+empty_moov+default_base_moof -flush_packets 1 -tune zerolatency"
@@ -128,6 +422,39 @@ func (a *AppConfig) setDefaultConfig() {
 			},
 		}
 	}
+
+	p := &a.FfmpegSettings.Protocols
+	if p.Rtmp == "" {
+		p.Rtmp = "-f flv"
+	}
+	if p.Rtmps == "" {
+		p.Rtmps = "-f flv"
+	}
+	if p.Srt == "" {
+		p.Srt = "-f mpegts"
+	}
+	if p.Hls == "" {
+		p.Hls = "-f hls -hls_time 4 -hls_list_size 6 -hls_flags delete_segments"
+	}
+
+	if a.FfmpegSettings.AudioOnlyRecording.PostInput == "" {
+		a.FfmpegSettings.AudioOnlyRecording = FfmpegOptions{
+			PreInput: "-loglevel error -thread_queue_size 512",
+			// fragmented, so that the file will be usable even if ffmpeg crashes
+			PostInput: "-vn -c:a aac -b:a 128k -af highpass=f=200,lowpass=f=4000,afftdn -frag_duration 2000000 -movflags empty_moov+default_base_moof -flush_packets 1 -y",
+		}
+		if a.Recorder.AudioOnly.Format == "ogg" {
+			a.FfmpegSettings.AudioOnlyRecording.PostInput = "-vn -c:a libopus -b:a 96k -af highpass=f=200,lowpass=f=4000,afftdn -flush_packets 1 -y"
+		}
+	}
+
+	if a.FfmpegSettings.SegmentedRecording.PostInput == "" {
+		// segment muxer will not accept mp4 movflags
+		a.FfmpegSettings.SegmentedRecording = FfmpegOptions{
+			PreInput:  "-loglevel error -thread_queue_size 512 -draw_mouse 0",
+			PostInput: "-c:v libx264 -x264-params keyint=120:scenecut=0 -preset veryfast -crf 23 -c:a aac -af highpass=f=200,lowpass=f=2000,afftdn -async 1 -flush_packets 1 -tune zerolatency -y",
+		}
+	}
 }
 
 func (a *AppConfig) setLogger() {
@@ -167,6 +494,20 @@ func (a *AppConfig) setLogger() {
 		w = io.Writer(logWriter)
 	}
 	logrus.SetOutput(w)
+
+	rl := a.LogSettings.RecordingLogs
+	if rl.Enabled {
+		if strings.HasPrefix(rl.Dir, "./") {
+			rl.Dir = filepath.Join(a.RootWorkingDir, rl.Dir)
+		}
+		if rl.MaxSize == 0 {
+			rl.MaxSize = 20
+		}
+		if rl.MaxAge == 0 {
+			rl.MaxAge = 7
+		}
+		tasklog.EnableFiles(rl.Dir, rl.MaxSize, rl.MaxAge)
+	}
 }
 
 func GetConfig() *AppConfig {
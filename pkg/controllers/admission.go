@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errTaskInProgress = errors.New("this request in progress")
+	errDraining       = errors.New("recorder is draining, not accepting new tasks")
+)
+
+// admissionController keeps track of the slots reserved on this recorder,
+// so that we never run more sessions than Recorder.MaxLimit even if the server
+// sends more requests than we can handle
+type admissionController struct {
+	cnf *config.AppConfig
+
+	sync.Mutex
+	slots    map[string]*admissionSlot
+	draining bool
+}
+
+type admissionSlot struct {
+	// already counted in CURRENT_PROGRESS
+	counted bool
+	// output attached to the running session of another task,
+	// it doesn't take a slot of MaxLimit
+	attached bool
+}
+
+func newAdmissionController(cnf *config.AppConfig) *admissionController {
+	return &admissionController{
+		cnf:   cnf,
+		slots: make(map[string]*admissionSlot),
+	}
+}
+
+// reserve will atomically book a slot for the task id
+// or return an error explaining why the task can't be accepted.
+// An attached output is only checked for duplicates & draining.
+func (a *admissionController) reserve(id string, attached bool) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if _, ok := a.slots[id]; ok {
+		return errTaskInProgress
+	}
+	if a.draining {
+		return errDraining
+	}
+	if !attached {
+		if err := a.checkCapacity(); err != nil {
+			return err
+		}
+	}
+
+	a.slots[id] = &admissionSlot{attached: attached}
+	return nil
+}
+
+// promote turns the attached output id into a session of its own,
+// e.g. if the session was closed before attaching to it
+func (a *admissionController) promote(id string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	s, ok := a.slots[id]
+	if !ok || !s.attached {
+		return nil
+	}
+	if err := a.checkCapacity(); err != nil {
+		return err
+	}
+	s.attached = false
+	return nil
+}
+
+// handOver moves the slot of id to the output attached to its session,
+// since the session keeps running for it. It returns false if to isn't attached.
+func (a *admissionController) handOver(id, to string) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	s, ok := a.slots[id]
+	t, tok := a.slots[to]
+	if !ok || s.attached || !tok || !t.attached {
+		return false
+	}
+	t.attached = false
+	t.counted = s.counted
+	delete(a.slots, id)
+	return true
+}
+
+// checkCapacity must be called with the lock
+func (a *admissionController) checkCapacity() error {
+	if uint64(a.countSessions()) >= a.cnf.Recorder.MaxLimit {
+		return fmt.Errorf("recorder %s is at max limit of %d tasks", a.cnf.Recorder.Id, a.cnf.Recorder.MaxLimit)
+	}
+	return a.checkHostResources()
+}
+
+// markCounted records that the slot was added to CURRENT_PROGRESS
+func (a *admissionController) markCounted(id string) {
+	a.Lock()
+	defer a.Unlock()
+	if s, ok := a.slots[id]; ok {
+		s.counted = true
+	}
+}
+
+// release frees the slot of the task id.
+// counted will be true if CURRENT_PROGRESS need to be decremented for this slot
+func (a *admissionController) release(id string) (counted bool, ok bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	s, ok := a.slots[id]
+	if !ok {
+		return false, false
+	}
+	delete(a.slots, id)
+	return s.counted, true
+}
+
+// startDraining will reject all new tasks from now on
+func (a *admissionController) startDraining() {
+	a.Lock()
+	defer a.Unlock()
+	a.draining = true
+}
+
+// stopDraining will accept new tasks again
+func (a *admissionController) stopDraining() {
+	a.Lock()
+	defer a.Unlock()
+	a.draining = false
+}
+
+func (a *admissionController) isDraining() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.draining
+}
+
+// active returns the number of running tasks, including attached outputs
+func (a *admissionController) active() int {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.slots)
+}
+
+// sessions returns the number of slots taken from MaxLimit
+func (a *admissionController) sessions() int {
+	a.Lock()
+	defer a.Unlock()
+	return a.countSessions()
+}
+
+func (a *admissionController) countSessions() int {
+	n := 0
+	for _, s := range a.slots {
+		if !s.attached {
+			n++
+		}
+	}
+	return n
+}
+
+func (a *admissionController) checkHostResources() error {
+	s := a.cnf.Recorder.Admission
+	if s.MaxCpuLoad == 0 && s.MinFreeMemoryMb == 0 && s.MinFreeDiskMb == 0 {
+		return nil
+	}
+
+	res, err := utils.GetHostResources(a.cnf.Recorder.CopyToPath.MainPath)
+	if err != nil {
+		// we shouldn't block recordings because of unreadable stats
+		log.Errorln("admission: unable to read host resources:", err)
+		return nil
+	}
+
+	if s.MaxCpuLoad > 0 && res.LoadPerCpu > s.MaxCpuLoad {
+		return fmt.Errorf("recorder %s cpu load %.2f per core is above limit %.2f", a.cnf.Recorder.Id, res.LoadPerCpu, s.MaxCpuLoad)
+	}
+	if s.MinFreeMemoryMb > 0 && res.MemFreeMb < s.MinFreeMemoryMb {
+		return fmt.Errorf("recorder %s free memory %dMB is below limit %dMB", a.cnf.Recorder.Id, res.MemFreeMb, s.MinFreeMemoryMb)
+	}
+	if s.MinFreeDiskMb > 0 && res.DiskFreeMb < s.MinFreeDiskMb {
+		return fmt.Errorf("recorder %s free disk %dMB is below limit %dMB", a.cnf.Recorder.Id, res.DiskFreeMb, s.MinFreeDiskMb)
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+)
+
+func newTestAdmission(maxLimit uint64) *admissionController {
+	cnf := new(config.AppConfig)
+	cnf.Recorder.Id = "node_01"
+	cnf.Recorder.MaxLimit = maxLimit
+	return newAdmissionController(cnf)
+}
+
+func TestAdmissionParallelReserves(t *testing.T) {
+	const maxLimit = 5
+	a := newTestAdmission(maxLimit)
+
+	var admitted atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i <= maxLimit; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			<-start
+			if err := a.reserve(id, false); err == nil {
+				admitted.Add(1)
+			}
+		}(fmt.Sprintf("%d-1", i+1))
+	}
+	close(start)
+	wg.Wait()
+
+	if admitted.Load() != maxLimit || a.active() != maxLimit {
+		t.Fatalf("admitted: %d, active: %d, want %d", admitted.Load(), a.active(), maxLimit)
+	}
+}
+
+func TestAdmissionRelease(t *testing.T) {
+	a := newTestAdmission(1)
+
+	if err := a.reserve("1-1", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.reserve("1-1", false); !errors.Is(err, errTaskInProgress) {
+		t.Fatalf("same task must be in progress, got: %v", err)
+	}
+
+	// failed before CURRENT_PROGRESS was incremented
+	counted, ok := a.release("1-1")
+	if !ok || counted {
+		t.Fatalf("release without count, counted: %t, ok: %t", counted, ok)
+	}
+	// released twice, e.g. abort & onAfterClose, must not decrement again
+	if counted, ok := a.release("1-1"); ok || counted {
+		t.Fatalf("second release, counted: %t, ok: %t", counted, ok)
+	}
+
+	if err := a.reserve("1-1", false); err != nil {
+		t.Fatal("slot wasn't freed:", err)
+	}
+	a.markCounted("1-1")
+	if counted, ok := a.release("1-1"); !ok || !counted {
+		t.Fatalf("release of counted slot, counted: %t, ok: %t", counted, ok)
+	}
+	// a released slot can't be marked
+	a.markCounted("1-1")
+	if a.active() != 0 {
+		t.Fatal("markCounted has reserved a slot")
+	}
+}
+
+func TestAdmissionDraining(t *testing.T) {
+	a := newTestAdmission(2)
+	a.startDraining()
+	if err := a.reserve("1-1", false); !errors.Is(err, errDraining) {
+		t.Fatalf("expected draining error, got: %v", err)
+	}
+	if err := a.reserve("1-2", true); !errors.Is(err, errDraining) {
+		t.Fatalf("attached output must be rejected while draining, got: %v", err)
+	}
+	a.stopDraining()
+	if err := a.reserve("1-1", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdmissionAttachedOutputs(t *testing.T) {
+	a := newTestAdmission(1)
+
+	if err := a.reserve("1-1", false); err != nil {
+		t.Fatal(err)
+	}
+	a.markCounted("1-1")
+	// the session is full, but an output attached to it doesn't need a slot
+	if err := a.reserve("1-2", true); err != nil {
+		t.Fatal("attached output was rejected:", err)
+	}
+	if err := a.reserve("2-1", false); err == nil {
+		t.Fatal("new session was accepted above max limit")
+	}
+	if err := a.reserve("1-2", true); !errors.Is(err, errTaskInProgress) {
+		t.Fatalf("duplicate attached output, got: %v", err)
+	}
+	if a.active() != 2 || a.sessions() != 1 {
+		t.Fatalf("active: %d, sessions: %d", a.active(), a.sessions())
+	}
+
+	// owner has ended but the session keeps running for the attached output
+	if !a.handOver("1-1", "1-2") {
+		t.Fatal("slot wasn't handed over")
+	}
+	if _, ok := a.release("1-1"); ok {
+		t.Fatal("handed over slot is still reserved")
+	}
+	if a.active() != 1 || a.sessions() != 1 {
+		t.Fatalf("after hand over, active: %d, sessions: %d", a.active(), a.sessions())
+	}
+	if err := a.reserve("2-1", false); err == nil {
+		t.Fatal("new session was accepted while the shared session is running")
+	}
+
+	// the counted slot goes with it
+	counted, ok := a.release("1-2")
+	if !ok || !counted {
+		t.Fatalf("release of the handed over slot, counted: %t, ok: %t", counted, ok)
+	}
+	if err := a.reserve("2-1", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdmissionHandOverNeedsAttachedOutput(t *testing.T) {
+	a := newTestAdmission(2)
+	_ = a.reserve("1-1", false)
+	_ = a.reserve("1-2", false)
+
+	// separate sessions, each one has its own slot
+	if a.handOver("1-1", "1-2") {
+		t.Fatal("slot was handed over to a session")
+	}
+	if a.handOver("1-1", "3-2") {
+		t.Fatal("slot was handed over to an unknown task")
+	}
+	if a.sessions() != 2 {
+		t.Fatalf("sessions: %d", a.sessions())
+	}
+}
+
+func TestAdmissionPromote(t *testing.T) {
+	a := newTestAdmission(1)
+	_ = a.reserve("1-1", false)
+	_ = a.reserve("1-2", true)
+
+	// the session was closing, but its slot is still reserved
+	if err := a.promote("1-2"); err == nil {
+		t.Fatal("attached output was promoted above max limit")
+	}
+	a.release("1-1")
+	if err := a.promote("1-2"); err != nil {
+		t.Fatal(err)
+	}
+	if a.sessions() != 1 {
+		t.Fatalf("sessions: %d", a.sessions())
+	}
+	if err := a.reserve("2-1", false); err == nil {
+		t.Fatal("new session was accepted above max limit")
+	}
+}
@@ -1,15 +1,24 @@
 package controllers
 
 import (
+	"context"
 	"fmt"
+	"path"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/WeMeet-recorder/pkg/journal"
+	"github.com/retawsolit/WeMeet-recorder/pkg/outbox"
 	"github.com/retawsolit/WeMeet-recorder/pkg/recorder"
+	hlsservice "github.com/retawsolit/WeMeet-recorder/pkg/services/hls"
+	httpservice "github.com/retawsolit/WeMeet-recorder/pkg/services/http"
 	natsservice "github.com/retawsolit/WeMeet-recorder/pkg/services/nats"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tracing"
 	"github.com/retawsolit/WeMeet-recorder/version"
 	"github.com/retawsolit/wemeet-protocol/wemeet"
 	log "github.com/sirupsen/logrus"
@@ -21,6 +30,26 @@ type RecorderController struct {
 	ns                  *natsservice.NatsService
 	closeTicker         chan bool
 	recordersInProgress sync.Map
+	admission           *admissionController
+	handledTasks        *taskDedup
+	taskAuth            *taskAuthenticator
+	taskStreamCtx       jetstream.ConsumeContext
+	hls                 *hlsservice.HlsService
+	http                *httpservice.HttpService
+	postProcessing      sync.WaitGroup
+	journal             *journal.Journal
+	// journal entries & recordersInProgress are changed together with it
+	journalMu    sync.Mutex
+	outbox       *outbox.Outbox
+	closeOutbox  context.CancelFunc
+	outboxDone   chan struct{}
+	events       chan *natsservice.RecorderEvent
+	status       *recorderStatus
+	shuttingDown atomic.Bool
+	// start tasks by id, for join latency
+	taskReceivedAt sync.Map
+	// *taskTrace by id
+	taskTraces sync.Map
 }
 
 func NewRecorderController() *RecorderController {
@@ -31,18 +60,68 @@ func NewRecorderController() *RecorderController {
 		cnf:         cnf,
 		ns:          ns,
 		closeTicker: make(chan bool),
+		admission:   newAdmissionController(cnf),
+		// stream messages can arrive later than the same message from core nats
+		handledTasks: newTaskDedup(time.Hour),
+		taskAuth:     newTaskAuthenticator(cnf),
+		status:       newRecorderStatus(),
 	}
 }
 
 func (c *RecorderController) BootUp() {
+	var err error
+	c.journal, err = journal.Open(c.cnf.Recorder.StateDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// must be ready before reconciling, it will send notifications
+	c.outbox, err = outbox.New(path.Join(c.cnf.Recorder.StateDir, "outbox"), c.sendNotification,
+		time.Duration(c.cnf.Recorder.Outbox.MaxBackoff)*time.Second,
+		time.Duration(c.cnf.Recorder.Outbox.KeepDelivered)*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var outboxCtx context.Context
+	outboxCtx, c.closeOutbox = context.WithCancel(context.Background())
+	c.outboxDone = make(chan struct{})
+	go func() {
+		defer close(c.outboxDone)
+		c.outbox.Run(outboxCtx)
+	}()
+
 	// add this recorder to the bucket
-	err := c.ns.AddRecorder()
+	err = c.ns.AddRecorder()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if c.cnf.NatsInfo.Recorder.Events.Enabled {
+		if err = c.startEvents(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// tasks which were running before the restart
+	c.reconcileJournal()
 	// now start ping
 	go c.startPing()
 
+	if c.cnf.HttpServer.Enabled {
+		c.http = httpservice.New(c.cnf, c)
+		go func() {
+			if err := c.http.Run(); err != nil {
+				log.Errorln(err)
+			}
+		}()
+	}
+	if c.cnf.HlsServer.Enabled {
+		c.hls = hlsservice.New(c.cnf)
+		go func() {
+			if err := c.hls.Run(); err != nil {
+				log.Errorln(err)
+			}
+		}()
+	}
+
 	// try to recover if panic happens
 	defer func() {
 		if r := recover(); r != nil {
@@ -58,69 +137,85 @@ func (c *RecorderController) BootUp() {
 			log.Errorln(err)
 			return
 		}
-		if req.From != "wemeet" {
-			return
-		}
 
-		switch req.Task {
-		case wemeet.RecordingTasks_START_RECORDING,
-			wemeet.RecordingTasks_START_RTMP:
-			if req.RecorderId == c.cnf.Recorder.Id {
-				res := &wemeet.CommonResponse{
-					Status: true,
-					Msg:    "success",
-				}
-				err := c.handleStartTask(req)
-				if err != nil {
-					res.Status = false
-					res.Msg = err.Error()
-				}
-				marshal, _ := proto.Marshal(res)
-				err = msg.Respond(marshal)
-				if err != nil {
-					log.Errorln(err)
-				}
-			}
-		case wemeet.RecordingTasks_STOP_RECORDING,
-			wemeet.RecordingTasks_STOP_RTMP,
-			wemeet.RecordingTasks_STOP:
-			ok := c.handleStopTask(req)
-			if ok {
-				// then the process was in this recorder
-				res := &wemeet.CommonResponse{
-					Status: true,
-					Msg:    "success",
-				}
-				marshal, _ := proto.Marshal(res)
-				err := msg.Respond(marshal)
-				if err != nil {
-					log.Errorln(err)
-				}
+		ctx, span := tracing.Start(tracing.FromNatsHeader(msg.Header), "nats receive", tracing.TaskAttributes(req)...)
+		defer span.End()
+
+		maxAge := time.Duration(c.cnf.NatsInfo.Recorder.TaskAuth.MaxAge) * time.Second
+		var res *wemeet.CommonResponse
+		if err := c.taskAuth.authorize(req, msg.Data, msg.Header, intakeCore, maxAge); err != nil {
+			span.RecordError(err)
+			// let the server know if the task was for us
+			if c.isStartTaskForMe(req) {
+				res = c.rejectTask(req, err)
 			}
-		default:
-			log.Errorln(fmt.Sprintf("invalid task %s received", req.Task.String()))
+		} else {
+			res = c.handleTask(ctx, req)
+		}
+		if res == nil {
+			return
+		}
+		marshal, _ := proto.Marshal(res)
+		err = msg.Respond(marshal)
+		if err != nil {
+			log.Errorln(err)
 		}
 	})
-
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if c.cnf.NatsInfo.Recorder.TaskStream.Enabled {
+		if err = c.consumeTaskStream(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if c.cnf.NatsInfo.Recorder.Admin.Enabled {
+		if err = c.subscribeAdmin(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	fmt.Println(fmt.Sprintf("recorder is ready to accept tasks, recorderId: %s; version: %s; runtime: %s", c.cnf.Recorder.Id, version.Version, runtime.Version()))
 }
 
-func (c *RecorderController) CallEndToAll() {
+// CallEndToAll closes the running tasks and the services,
+// pending notifications will be delivered until ctx is done
+func (c *RecorderController) CallEndToAll(ctx context.Context) {
+	if c.taskStreamCtx != nil {
+		c.taskStreamCtx.Stop()
+	}
+	c.closeAll()
+	if c.hls != nil {
+		c.hls.Close()
+	}
+	if c.http != nil {
+		c.http.Close()
+	}
+	if c.closeOutbox != nil {
+		if err := c.outbox.Flush(ctx); err != nil {
+			// those will be delivered after the next start
+			log.Errorln(err)
+		}
+		c.closeOutbox()
+		<-c.outboxDone
+	}
+	close(c.closeTicker)
+}
+
+// closeAll will close all the running sessions
+func (c *RecorderController) closeAll() {
 	c.recordersInProgress.Range(func(key, value interface{}) bool {
 		if process, ok := value.(*recorder.Recorder); ok {
 			process.Close(nil)
 		}
 		return true
 	})
-	close(c.closeTicker)
 }
 
 func (c *RecorderController) startPing() {
 	ping := time.NewTicker(3 * time.Second)
+	c.initStatus()
 
 	for {
 		select {
@@ -131,6 +226,7 @@ func (c *RecorderController) startPing() {
 			if err != nil {
 				log.Errorln(err)
 			}
+			c.updateStatus()
 		}
 	}
 }
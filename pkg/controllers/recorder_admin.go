@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/retawsolit/WeMeet-recorder/pkg/recorder"
+	natsservice "github.com/retawsolit/WeMeet-recorder/pkg/services/nats"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	log "github.com/sirupsen/logrus"
+)
+
+// actions of the admin api
+const (
+	adminListTasks   = "list_tasks"
+	adminGetTask     = "get_task"
+	adminStopTask    = "stop_task"
+	adminSetDraining = "set_draining"
+	adminSetLogLevel = "set_log_level"
+	adminScreenshot  = "screenshot"
+)
+
+// error codes of the admin api
+const (
+	adminCodeOk            = "ok"
+	adminCodeBadRequest    = "bad_request"
+	adminCodeUnknownAction = "unknown_action"
+	adminCodeNotFound      = "not_found"
+	adminCodeTooLarge      = "too_large"
+	adminCodeInternal      = "internal_error"
+)
+
+const (
+	adminScreenshotTimeout = 10 * time.Second
+	adminScreenshotQuality = 60
+)
+
+type adminRequest struct {
+	Action string `json:"action"`
+	// task id (room table id-task) or recording id
+	Id          string `json:"id,omitempty"`
+	RecordingId string `json:"recording_id,omitempty"`
+	Enabled     *bool  `json:"enabled,omitempty"`
+	Level       string `json:"level,omitempty"`
+	// jpeg quality of the screenshot
+	Quality int `json:"quality,omitempty"`
+}
+
+type adminResponse struct {
+	Status bool        `json:"status"`
+	Code   string      `json:"code"`
+	Msg    string      `json:"msg,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+type adminScreenshotData struct {
+	TaskId string `json:"task_id"`
+	// jpeg, base64 encoded in json
+	Image []byte `json:"image"`
+}
+
+// subscribeAdmin will serve the admin api on <subject>.<recorder id>
+func (c *RecorderController) subscribeAdmin() error {
+	subject := fmt.Sprintf("%s.%s", c.cnf.NatsInfo.Recorder.Admin.Subject, c.cnf.Recorder.Id)
+	_, err := c.cnf.NatsConn.Subscribe(subject, func(msg *nats.Msg) {
+		res := c.handleAdminRequest(msg.Data)
+		data, err := json.Marshal(res)
+		if err != nil {
+			log.Errorln(err)
+			return
+		}
+		if err := msg.Respond(data); err != nil {
+			log.Errorln(err)
+		}
+	})
+	return err
+}
+
+func (c *RecorderController) handleAdminRequest(data []byte) *adminResponse {
+	req := new(adminRequest)
+	if err := json.Unmarshal(data, req); err != nil {
+		return adminError(adminCodeBadRequest, err.Error())
+	}
+	log.Infoln(fmt.Sprintf("received admin request, action: %s, id: %s, recordingId: %s", req.Action, req.Id, req.RecordingId))
+
+	switch req.Action {
+	case adminListTasks:
+		tasks := c.activeTasks(time.Now().UTC())
+		if tasks == nil {
+			tasks = []*natsservice.TaskStatus{}
+		}
+		return adminOk(tasks)
+
+	case adminGetTask:
+		tasks, res := c.findAdminTasks(req)
+		if res != nil {
+			return res
+		}
+		return adminOk(tasks)
+
+	case adminStopTask:
+		tasks, res := c.findAdminTasks(req)
+		if res != nil {
+			return res
+		}
+		for _, ts := range tasks {
+			task, _ := taskOfId(ts.Id)
+			if process, ok := c.getAndDeleteRecorderInProgress(ts.RoomTableId, task); ok {
+				taskReq := &wemeet.WeMeetToRecorder{
+					RecorderId:  c.cnf.Recorder.Id,
+					RoomId:      ts.RoomId,
+					RoomTableId: ts.RoomTableId,
+					RecordingId: ts.RecordingId,
+					Task:        task,
+				}
+				tasklog.Entry(taskReq).Infoln(fmt.Sprintf("stopping task: %s, roomTableId: %d by admin request", ts.Task, ts.RoomTableId))
+				go process.DetachOutput(task, nil)
+			}
+		}
+		return adminOk(tasks)
+
+	case adminSetDraining:
+		if req.Enabled == nil {
+			return adminError(adminCodeBadRequest, "enabled is required")
+		}
+		if err := c.SetDraining(*req.Enabled); err != nil {
+			return adminError(adminCodeBadRequest, err.Error())
+		}
+		return adminOk(nil)
+
+	case adminSetLogLevel:
+		level, err := log.ParseLevel(strings.ToLower(req.Level))
+		if err != nil {
+			return adminError(adminCodeBadRequest, err.Error())
+		}
+		log.SetLevel(level)
+		return adminOk(nil)
+
+	case adminScreenshot:
+		return c.adminScreenshot(req)
+	}
+
+	return adminError(adminCodeUnknownAction, fmt.Sprintf("unknown action: %q", req.Action))
+}
+
+// findAdminTasks returns the active tasks matching the id or recording id of req
+func (c *RecorderController) findAdminTasks(req *adminRequest) ([]*natsservice.TaskStatus, *adminResponse) {
+	if req.Id == "" && req.RecordingId == "" {
+		return nil, adminError(adminCodeBadRequest, "id or recording_id is required")
+	}
+
+	var tasks []*natsservice.TaskStatus
+	for _, ts := range c.activeTasks(time.Now().UTC()) {
+		if (req.Id != "" && ts.Id == req.Id) || (req.RecordingId != "" && ts.RecordingId == req.RecordingId) {
+			tasks = append(tasks, ts)
+		}
+	}
+	if len(tasks) == 0 {
+		return nil, adminError(adminCodeNotFound, "no active task found")
+	}
+	return tasks, nil
+}
+
+func (c *RecorderController) adminScreenshot(req *adminRequest) *adminResponse {
+	tasks, res := c.findAdminTasks(req)
+	if res != nil {
+		return res
+	}
+	// sessions may be shared, so the first one is enough
+	ts := tasks[0]
+	val, ok := c.recordersInProgress.Load(ts.Id)
+	if !ok {
+		return adminError(adminCodeNotFound, "no active task found")
+	}
+	process, ok := val.(*recorder.Recorder)
+	if !ok {
+		return adminError(adminCodeInternal, "invalid recorder")
+	}
+
+	quality := req.Quality
+	if quality <= 0 || quality > 100 {
+		quality = adminScreenshotQuality
+	}
+	img, err := process.Screenshot(adminScreenshotTimeout, quality)
+	if err != nil {
+		return adminError(adminCodeInternal, err.Error())
+	}
+	// base64 will need 4/3 of the size
+	if max := c.cnf.NatsConn.MaxPayload(); int64(len(img))*4/3+1024 > max {
+		return adminError(adminCodeTooLarge, fmt.Sprintf("screenshot of %d bytes is too large for nats max payload: %d, try a lower quality", len(img), max))
+	}
+
+	return adminOk(&adminScreenshotData{
+		TaskId: ts.Id,
+		Image:  img,
+	})
+}
+
+func adminOk(data interface{}) *adminResponse {
+	return &adminResponse{
+		Status: true,
+		Code:   adminCodeOk,
+		Data:   data,
+	}
+}
+
+func adminError(code, msg string) *adminResponse {
+	return &adminResponse{
+		Code: code,
+		Msg:  msg,
+	}
+}
@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/WeMeet-recorder/pkg/metrics"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
+	"github.com/retawsolit/wemeet-protocol/auth"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+const (
+	taskAuthOff        = "off"
+	taskAuthPermissive = "permissive"
+
+	// same headers as used by NotifyToWeMeet
+	apiKeyHeader        = "API-KEY"
+	hashSignatureHeader = "HASH-SIGNATURE"
+	timestampHeader     = "TIMESTAMP"
+	nonceHeader         = "NONCE"
+	authorizationHeader = "Authorization"
+
+	// claim of the bearer token with the hex encoded sha256 of the message body
+	bodyHashClaim = "body_sha256"
+
+	intakeCore   = "core"
+	intakeStream = "stream"
+)
+
+var errUnsignedTask = errors.New("task is not signed")
+
+// taskAuthenticator verifies that a task was sent by WeMeet server.
+// A task must have one of the followings in nats headers:
+//
+//   - API-KEY, TIMESTAMP (unix seconds), NONCE & HASH-SIGNATURE, where signature is
+//     hex encoded HMAC-SHA256 of TIMESTAMP + NONCE + message body using api_secret
+//   - Authorization: Bearer JWT, generated with api_key & api_secret. It must be short-lived
+//     (expiry within max_age), bound to the message by body_sha256 claim
+//     and every token can be used only once.
+type taskAuthenticator struct {
+	cnf *config.AppConfig
+	sync.Mutex
+	// key is intake + nonce, the same message will arrive from core nats & task stream.
+	// value is the time after which it can be forgotten.
+	nonces   map[string]time.Time
+	rejected atomic.Uint64
+}
+
+func newTaskAuthenticator(cnf *config.AppConfig) *taskAuthenticator {
+	return &taskAuthenticator{
+		cnf:    cnf,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// authorize returns error if the task should be rejected
+func (a *taskAuthenticator) authorize(req *wemeet.WeMeetToRecorder, data []byte, header nats.Header, intake string, maxAge time.Duration) error {
+	mode := a.cnf.NatsInfo.Recorder.TaskAuth.Mode
+	if mode == taskAuthOff {
+		return nil
+	}
+
+	err := a.verify(data, header, intake, maxAge)
+	if err == nil {
+		return nil
+	}
+
+	total := a.rejected.Add(1)
+	metrics.TaskAuthRejected.Inc()
+	tasklog.Entry(req).Warnln(fmt.Sprintf("task: %s, roomTableId: %d failed signature check, reason: %s, mode: %s, total failed: %d", req.Task.String(), req.GetRoomTableId(), err.Error(), mode, total))
+	if mode == taskAuthPermissive {
+		return nil
+	}
+	return err
+}
+
+// Rejected returns the number of tasks which have failed the signature check
+func (a *taskAuthenticator) Rejected() uint64 {
+	return a.rejected.Load()
+}
+
+func (a *taskAuthenticator) verify(data []byte, header nats.Header, intake string, maxAge time.Duration) error {
+	if bearer := header.Get(authorizationHeader); bearer != "" {
+		scheme, token, ok := strings.Cut(strings.TrimSpace(bearer), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return errors.New("authorization must be a bearer token")
+		}
+		token = strings.TrimSpace(token)
+		if _, err := auth.VerifyWeMeetAccessToken(a.cnf.WeMeetInfo.ApiKey, a.cnf.WeMeetInfo.ApiSecret, token, true); err != nil {
+			return fmt.Errorf("invalid token: %w", err)
+		}
+		// signature is already verified, we only need the expiry
+		tok, err := jwt.ParseSigned(token, []jose.SignatureAlgorithm{jose.HS256})
+		if err != nil {
+			return fmt.Errorf("invalid token: %w", err)
+		}
+		claims := jwt.Claims{}
+		custom := make(map[string]interface{})
+		if err := tok.UnsafeClaimsWithoutVerification(&claims, &custom); err != nil {
+			return fmt.Errorf("invalid token: %w", err)
+		}
+		if claims.Expiry == nil || time.Until(claims.Expiry.Time()) > maxAge {
+			return errors.New("token must expire within max_age")
+		}
+		// validation of the token allows some leeway, but an expired one must not be used
+		if !time.Now().Before(claims.Expiry.Time()) {
+			return errors.New("token is expired")
+		}
+		// otherwise the token of a task could be used for any other message
+		bodyHash, _ := custom[bodyHashClaim].(string)
+		if bodyHash == "" {
+			return fmt.Errorf("token must have %s claim", bodyHashClaim)
+		}
+		body := sha256.Sum256(data)
+		if !hmac.Equal([]byte(hex.EncodeToString(body[:])), []byte(strings.ToLower(bodyHash))) {
+			return errors.New("token doesn't match the message body")
+		}
+		// it can't be used after expiry, so remembering it till max_age is enough
+		sum := sha256.Sum256([]byte(token))
+		return a.useNonce(intake, hex.EncodeToString(sum[:]), maxAge)
+	}
+
+	signature := header.Get(hashSignatureHeader)
+	if signature == "" {
+		return errUnsignedTask
+	}
+	if header.Get(apiKeyHeader) != a.cnf.WeMeetInfo.ApiKey {
+		return errors.New("invalid api key")
+	}
+
+	ts, nonce := header.Get(timestampHeader), header.Get(nonceHeader)
+	if ts == "" || nonce == "" {
+		return errors.New("timestamp and nonce are required")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > maxAge || d < -maxAge {
+		return errors.New("timestamp is out of allowed range")
+	}
+
+	mac := hmac.New(sha256.New, []byte(a.cnf.WeMeetInfo.ApiSecret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte(nonce))
+	mac.Write(data)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return errors.New("invalid signature")
+	}
+
+	return a.useNonce(intake, nonce, maxAge)
+}
+
+// useNonce will return error if the nonce was used before within maxAge
+func (a *taskAuthenticator) useNonce(intake, nonce string, maxAge time.Duration) error {
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	for k, expiry := range a.nonces {
+		if now.After(expiry) {
+			delete(a.nonces, k)
+		}
+	}
+
+	key := intake + "-" + nonce
+	if _, ok := a.nonces[key]; ok {
+		return errors.New("nonce was already used")
+	}
+	// older messages will be rejected by timestamp anyway
+	a.nonces[key] = now.Add(2 * maxAge)
+	return nil
+}
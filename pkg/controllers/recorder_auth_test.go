@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+const (
+	testApiKey    = "test_key"
+	testApiSecret = "test_secret_which_is_long_enough_for_hs256"
+	testMaxAge    = 30 * time.Second
+)
+
+func newTestAuthenticator() *taskAuthenticator {
+	cnf := &config.AppConfig{}
+	cnf.WeMeetInfo.ApiKey = testApiKey
+	cnf.WeMeetInfo.ApiSecret = testApiSecret
+	cnf.NatsInfo.Recorder.TaskAuth.Mode = "enforce"
+	return newTaskAuthenticator(cnf)
+}
+
+func hmacHeader(t *testing.T, body []byte, ts time.Time, nonce string) nats.Header {
+	t.Helper()
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(testApiSecret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte(nonce))
+	mac.Write(body)
+
+	h := nats.Header{}
+	h.Set(apiKeyHeader, testApiKey)
+	h.Set(timestampHeader, timestamp)
+	h.Set(nonceHeader, nonce)
+	h.Set(hashSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return h
+}
+
+func bearerHeader(t *testing.T, prefix string, body []byte, validity time.Duration) nats.Header {
+	t.Helper()
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte(testApiSecret)}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	claims := jwt.Claims{
+		Issuer:    testApiKey,
+		NotBefore: jwt.NewNumericDate(now.Add(-time.Second)),
+		Expiry:    jwt.NewNumericDate(now.Add(validity)),
+	}
+	custom := map[string]interface{}{}
+	if body != nil {
+		sum := sha256.Sum256(body)
+		custom[bodyHashClaim] = hex.EncodeToString(sum[:])
+	}
+	token, err := jwt.Signed(sig).Claims(claims).Claims(custom).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := nats.Header{}
+	h.Set(authorizationHeader, prefix+token)
+	return h
+}
+
+func TestTaskAuthenticatorVerify(t *testing.T) {
+	body := []byte("start recording")
+	tampered := []byte("stop recording")
+
+	tests := []struct {
+		name   string
+		header func(t *testing.T) nats.Header
+		data   []byte
+		// verified twice, to check the replay
+		replay  bool
+		wantErr bool
+	}{
+		{
+			name:   "unsigned",
+			header: func(t *testing.T) nats.Header { return nats.Header{} },
+			data:   body, wantErr: true,
+		},
+		{
+			name:   "hmac valid",
+			header: func(t *testing.T) nats.Header { return hmacHeader(t, body, time.Now(), "n1") },
+			data:   body,
+		},
+		{
+			name:   "hmac tampered body",
+			header: func(t *testing.T) nats.Header { return hmacHeader(t, body, time.Now(), "n2") },
+			data:   tampered, wantErr: true,
+		},
+		{
+			name:   "hmac replayed",
+			header: func(t *testing.T) nats.Header { return hmacHeader(t, body, time.Now(), "n3") },
+			data:   body, replay: true, wantErr: true,
+		},
+		{
+			name:   "hmac expired",
+			header: func(t *testing.T) nats.Header { return hmacHeader(t, body, time.Now().Add(-2*testMaxAge), "n4") },
+			data:   body, wantErr: true,
+		},
+		{
+			name:   "hmac from the future",
+			header: func(t *testing.T) nats.Header { return hmacHeader(t, body, time.Now().Add(2*testMaxAge), "n5") },
+			data:   body, wantErr: true,
+		},
+		{
+			name: "hmac wrong api key",
+			header: func(t *testing.T) nats.Header {
+				h := hmacHeader(t, body, time.Now(), "n6")
+				h.Set(apiKeyHeader, "other")
+				return h
+			},
+			data: body, wantErr: true,
+		},
+		{
+			name:   "jwt valid",
+			header: func(t *testing.T) nats.Header { return bearerHeader(t, "Bearer ", body, 10*time.Second) },
+			data:   body,
+		},
+		{
+			name:   "jwt lowercase bearer",
+			header: func(t *testing.T) nats.Header { return bearerHeader(t, "bearer ", body, 10*time.Second) },
+			data:   body,
+		},
+		{
+			name:   "jwt tampered body",
+			header: func(t *testing.T) nats.Header { return bearerHeader(t, "Bearer ", body, 10*time.Second) },
+			data:   tampered, wantErr: true,
+		},
+		{
+			name:   "jwt replayed",
+			header: func(t *testing.T) nats.Header { return bearerHeader(t, "Bearer ", body, 10*time.Second) },
+			data:   body, replay: true, wantErr: true,
+		},
+		{
+			name:   "jwt expired",
+			header: func(t *testing.T) nats.Header { return bearerHeader(t, "Bearer ", body, -10*time.Second) },
+			data:   body, wantErr: true,
+		},
+		{
+			name:   "jwt expiry after max_age",
+			header: func(t *testing.T) nats.Header { return bearerHeader(t, "Bearer ", body, 2*testMaxAge) },
+			data:   body, wantErr: true,
+		},
+		{
+			name:   "jwt without body_sha256",
+			header: func(t *testing.T) nats.Header { return bearerHeader(t, "Bearer ", nil, 10*time.Second) },
+			data:   body, wantErr: true,
+		},
+		{
+			name:   "jwt without bearer prefix",
+			header: func(t *testing.T) nats.Header { return bearerHeader(t, "", body, 10*time.Second) },
+			data:   body, wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAuthenticator()
+			header := tt.header(t)
+			err := a.verify(tt.data, header, intakeCore, testMaxAge)
+			if tt.replay {
+				if err != nil {
+					t.Fatalf("first delivery failed: %v", err)
+				}
+				err = a.verify(tt.data, header, intakeCore, testMaxAge)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTaskAuthenticatorNonceIsPerIntake(t *testing.T) {
+	a := newTestAuthenticator()
+	body := []byte("start recording")
+	header := hmacHeader(t, body, time.Now(), "same")
+
+	// the same message arrives from core nats & task stream
+	if err := a.verify(body, header, intakeCore, testMaxAge); err != nil {
+		t.Fatalf("core: %v", err)
+	}
+	if err := a.verify(body, header, intakeStream, testMaxAge); err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if err := a.verify(body, header, intakeStream, testMaxAge); err == nil {
+		t.Fatal("replay on stream was accepted")
+	}
+}
+
+func TestTaskAuthenticatorAuthorizeModes(t *testing.T) {
+	body := []byte("start recording")
+	tests := []struct {
+		mode    string
+		wantErr bool
+	}{
+		{mode: taskAuthOff},
+		{mode: taskAuthPermissive},
+		{mode: "enforce", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			a := newTestAuthenticator()
+			a.cnf.NatsInfo.Recorder.TaskAuth.Mode = tt.mode
+			err := a.authorize(&wemeet.WeMeetToRecorder{}, body, nats.Header{}, intakeCore, testMaxAge)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("authorize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.mode != taskAuthOff && a.Rejected() != 1 {
+				t.Fatalf("rejected = %d, want 1", a.Rejected())
+			}
+		})
+	}
+}
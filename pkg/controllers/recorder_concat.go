@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/recorder"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+// concatSegments will join all usable segments of a segmented recording into
+// a single raw mp4 file without re-encoding. Missing or corrupt segments are skipped
+// and returned, so that we can report them.
+func (c *RecorderController) concatSegments(req *wemeet.WeMeetToRecorder, filePath string) (string, []string, error) {
+	segments, err := recorder.ListSegments(filePath, req.RecordingId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var skipped []string
+	// segments which ffmpeg had completed but aren't on the disk anymore
+	if listed, err := recorder.ReadSegmentLists(filePath, req.RecordingId); err == nil {
+		onDisk := make(map[string]bool, len(segments))
+		for _, s := range segments {
+			onDisk[s] = true
+		}
+		for _, s := range listed {
+			if !onDisk[s] {
+				skipped = append(skipped, s)
+			}
+		}
+	}
+
+	usable, corrupt := probeMediaFiles(req, filePath, segments)
+	skipped = append(skipped, corrupt...)
+	if len(usable) == 0 {
+		return "", skipped, errors.New("no usable segment found for recordingId: " + req.RecordingId)
+	}
+
+	rawFileName := req.RecordingId + "_raw.mp4"
+	if err := concatMediaFiles(req, filePath, usable, rawFileName); err != nil {
+		return "", skipped, err
+	}
+
+	// all good, so we don't need those anymore
+	for _, s := range segments {
+		if err := os.Remove(path.Join(filePath, s)); err != nil {
+			tasklog.Entry(req).Errorln(err)
+		}
+	}
+	for _, l := range recorder.SegmentListFiles(filePath, req.RecordingId) {
+		_ = os.Remove(path.Join(filePath, l))
+	}
+
+	return rawFileName, skipped, nil
+}
+
+// concatParts will join the parts written by every ffmpeg process of the recording
+func (c *RecorderController) concatParts(req *wemeet.WeMeetToRecorder, filePath string, parts []string) (string, []string, error) {
+	usable, skipped := probeMediaFiles(req, filePath, parts)
+	if len(usable) == 0 {
+		return "", skipped, errors.New("no usable part found for recordingId: " + req.RecordingId)
+	}
+
+	// first part is using _raw name, so we can't use it here
+	rawFileName := req.RecordingId + "_raw_joined" + path.Ext(parts[0])
+	if err := concatMediaFiles(req, filePath, usable, rawFileName); err != nil {
+		return "", skipped, err
+	}
+
+	for _, p := range parts {
+		if err := os.Remove(path.Join(filePath, p)); err != nil {
+			tasklog.Entry(req).Errorln(err)
+		}
+	}
+
+	return rawFileName, skipped, nil
+}
+
+// probeMediaFiles separates the files which can be read by ffprobe from the rest
+func probeMediaFiles(req *wemeet.WeMeetToRecorder, filePath string, files []string) (usable, skipped []string) {
+	for _, f := range files {
+		if err := probeMediaFile(path.Join(filePath, f)); err != nil {
+			tasklog.Entry(req).Errorln(fmt.Sprintf("skipping %s of recordingId: %s, reason: %s", f, req.RecordingId, err.Error()))
+			skipped = append(skipped, f)
+			continue
+		}
+		usable = append(usable, f)
+	}
+	return usable, skipped
+}
+
+// concatMediaFiles joins files into outFileName, it's a variable to be replaced by tests
+var concatMediaFiles = ffmpegConcat
+
+// ffmpegConcat joins files into outFileName using the concat demuxer without re-encoding
+func ffmpegConcat(req *wemeet.WeMeetToRecorder, filePath string, files []string, outFileName string) error {
+	// concat demuxer need a list with file directives
+	concatFile := path.Join(filePath, strings.TrimSuffix(outFileName, path.Ext(outFileName))+"_concat.txt")
+	var b strings.Builder
+	b.WriteString("ffconcat version 1.0\n")
+	for _, f := range files {
+		b.WriteString(fmt.Sprintf("file '%s'\n", f))
+	}
+	if err := os.WriteFile(concatFile, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(concatFile)
+
+	args := []string{
+		"-loglevel", "error",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", concatFile,
+		"-c", "copy",
+	}
+	if ext := path.Ext(outFileName); ext == ".mp4" || ext == ".m4a" {
+		args = append(args, "-movflags", "faststart")
+	}
+	args = append(args, "-y", path.Join(filePath, outFileName))
+	tasklog.Entry(req).Infoln("starting concat ffmpeg process with args:", strings.Join(args, " "))
+
+	if out, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+		_ = os.Remove(path.Join(filePath, outFileName))
+		return fmt.Errorf("failed to concat files: %s, %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// probeMediaFile returns an error if file can't be used, it's a variable to be replaced by tests
+var probeMediaFile = ffprobeMediaFile
+
+// ffprobeMediaFile makes sure that ffprobe can read the file
+func ffprobeMediaFile(file string) error {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 {
+		return errors.New("0 size")
+	}
+
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", file).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffprobe: %s, %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	if d := strings.TrimSpace(string(out)); d == "" || d == "N/A" {
+		return errors.New("unknown duration")
+	}
+
+	return nil
+}
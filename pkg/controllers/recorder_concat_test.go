@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/WeMeet-recorder/pkg/outbox"
+	"github.com/retawsolit/WeMeet-recorder/pkg/recorder"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// stubMedia replaces ffprobe & ffmpeg, files with "corrupt" content can't be probed.
+// It returns the files given to every concat.
+func stubMedia(t *testing.T) *[][]string {
+	t.Helper()
+	var concatenated [][]string
+	probe, concat := probeMediaFile, concatMediaFiles
+	t.Cleanup(func() {
+		probeMediaFile, concatMediaFiles = probe, concat
+	})
+
+	probeMediaFile = func(file string) error {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if string(data) == "corrupt" {
+			return errors.New("invalid data found when processing input")
+		}
+		return nil
+	}
+	concatMediaFiles = func(req *wemeet.WeMeetToRecorder, filePath string, files []string, outFileName string) error {
+		concatenated = append(concatenated, files)
+		return os.WriteFile(path.Join(filePath, outFileName), []byte("joined"), 0644)
+	}
+	return &concatenated
+}
+
+// writeSegments writes the segments & the list of a recording which was restarted once,
+// rec_raw_00002.ts was completed but is missing and rec_raw_00001.ts is corrupt
+func writeSegments(t *testing.T, dir string) {
+	t.Helper()
+	files := map[string]string{
+		"rec_raw_00000.ts":                       "ok",
+		"rec_raw_00001.ts":                       "corrupt",
+		"rec_raw_00003.ts":                       "ok",
+		"rec_raw_00004.ts":                       "ok",
+		"rec" + recorder.SegmentListSuffix:       "rec_raw_00000.ts\nrec_raw_00001.ts\nrec_raw_00002.ts\n",
+		"rec_part1" + recorder.SegmentListSuffix: "rec_raw_00003.ts\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcatSegmentsSkipsMissingAndCorrupt(t *testing.T) {
+	concatenated := stubMedia(t)
+	dir := t.TempDir()
+	writeSegments(t, dir)
+	c := &RecorderController{cnf: new(config.AppConfig)}
+
+	rawFileName, skipped, err := c.concatSegments(&wemeet.WeMeetToRecorder{RecordingId: "rec"}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rawFileName != "rec_raw.mp4" {
+		t.Fatalf("unexpected raw file: %s", rawFileName)
+	}
+	// the last segment isn't listed yet, but it's on the disk
+	want := [][]string{{"rec_raw_00000.ts", "rec_raw_00003.ts", "rec_raw_00004.ts"}}
+	if !reflect.DeepEqual(*concatenated, want) {
+		t.Fatalf("concatenated %v, want %v", *concatenated, want)
+	}
+	if want := []string{"rec_raw_00002.ts", "rec_raw_00001.ts"}; !reflect.DeepEqual(skipped, want) {
+		t.Fatalf("skipped %v, want %v", skipped, want)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != rawFileName {
+		t.Fatalf("segments & lists must be removed after concat, found: %v", files)
+	}
+}
+
+func TestConcatSegmentsWithoutUsableSegment(t *testing.T) {
+	concatenated := stubMedia(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "rec_raw_00000.ts"), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &RecorderController{cnf: new(config.AppConfig)}
+
+	_, skipped, err := c.concatSegments(&wemeet.WeMeetToRecorder{RecordingId: "rec"}, dir)
+	if err == nil {
+		t.Fatal("concat must fail without any usable segment")
+	}
+	if len(*concatenated) != 0 {
+		t.Fatal("nothing must be concatenated")
+	}
+	if !reflect.DeepEqual(skipped, []string{"rec_raw_00000.ts"}) {
+		t.Fatalf("unexpected skipped: %v", skipped)
+	}
+	// kept for manual recovery
+	if _, err := os.Stat(path.Join(dir, "rec_raw_00000.ts")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostProcessingReportsSkippedSegments(t *testing.T) {
+	stubMedia(t)
+	mainPath := t.TempDir()
+	dir := path.Join(mainPath, "room")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSegments(t, dir)
+
+	cnf := new(config.AppConfig)
+	cnf.Recorder.CopyToPath.MainPath = mainPath
+	minDuration := uint64(0)
+	cnf.Recorder.Validation.MinDuration = &minDuration
+	outboxDir := t.TempDir()
+	box, err := outbox.New(outboxDir, nil, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &RecorderController{cnf: cnf, outbox: box}
+
+	req := &wemeet.WeMeetToRecorder{RecordingId: "rec", RoomId: "room", RoomTableId: 1}
+	c.postProcessRecording(context.Background(), req, &recorder.Output{
+		FilePath:  dir,
+		FileNames: []string{"rec" + recorder.SegmentListSuffix},
+	})
+
+	msgs, err := outbox.List(outboxDir, outbox.Pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var proceeded *wemeet.RecorderToWeMeet
+	for _, m := range msgs {
+		n := new(wemeet.RecorderToWeMeet)
+		if err := protojson.Unmarshal(m.Payload, n); err != nil {
+			t.Fatal(err)
+		}
+		if n.Task == wemeet.RecordingTasks_RECORDING_PROCEEDED {
+			proceeded = n
+		}
+	}
+	if proceeded == nil {
+		t.Fatal("RECORDING_PROCEEDED wasn't sent")
+	}
+	if note := "skipped 2 missing or corrupt segments: rec_raw_00002.ts, rec_raw_00001.ts"; !strings.Contains(proceeded.Msg, note) {
+		t.Fatalf("message %q doesn't report the skipped segments", proceeded.Msg)
+	}
+	if proceeded.FilePath != "room/rec.mp4" {
+		t.Fatalf("unexpected file path: %s", proceeded.FilePath)
+	}
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errShuttingDown = errors.New("recorder is shutting down")
+
+// Drain will stop accepting new tasks and wait for the running ones to end naturally.
+// Remaining tasks will be closed once ctx is done, after that it will wait for the
+// post-processing of all recordings. Cancelling ctx won't stop waiting for post-processing,
+// so caller should not wait for it if the shutdown need to be forced.
+func (c *RecorderController) Drain(ctx context.Context) {
+	c.shuttingDown.Store(true)
+	_ = c.SetDraining(true)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+wait:
+	for c.admission.active() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Warnln(fmt.Sprintf("drain deadline reached, closing %d running tasks", c.admission.active()))
+			c.closeAll()
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	log.Infoln("waiting for post-processing to finish")
+	c.postProcessing.Wait()
+	log.Infoln(fmt.Sprintf("recorder: %s was drained", c.cnf.Recorder.Id))
+}
+
+// SetDraining will stop or start accepting new tasks without affecting the running ones
+func (c *RecorderController) SetDraining(enabled bool) error {
+	if !enabled && c.shuttingDown.Load() {
+		return errShuttingDown
+	}
+	if enabled == c.admission.isDraining() {
+		return nil
+	}
+
+	limit := c.cnf.Recorder.MaxLimit
+	if enabled {
+		c.admission.startDraining()
+		log.Infoln(fmt.Sprintf("draining recorder: %s, running tasks: %d", c.cnf.Recorder.Id, c.admission.active()))
+		// so that the server won't choose this recorder anymore
+		limit = 0
+	} else {
+		c.admission.stopDraining()
+		log.Infoln(fmt.Sprintf("recorder: %s is accepting new tasks again", c.cnf.Recorder.Id))
+	}
+
+	if err := c.ns.UpdateMaxLimit(limit); err != nil {
+		log.Errorln(err)
+	}
+	return nil
+}
+
+// IsDraining returns true if Drain was called
+func (c *RecorderController) IsDraining() bool {
+	return c.admission.isDraining()
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -8,38 +9,60 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/retawsolit/WeMeet-recorder/pkg/journal"
+	"github.com/retawsolit/WeMeet-recorder/pkg/metrics"
 	"github.com/retawsolit/WeMeet-recorder/pkg/recorder"
-	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tracing"
 	"github.com/retawsolit/wemeet-protocol/wemeet"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
-func (c *RecorderController) handleStopTask(req *wemeet.WeMeetToRecorder) bool {
-	log.Infoln(fmt.Sprintf("received new stop task: %s, roomTableId: %d, roomId: %s, sId: %s", req.Task.String(), req.GetRoomTableId(), req.GetRoomId(), req.GetRoomSid()))
+func (c *RecorderController) handleStopTask(ctx context.Context, req *wemeet.WeMeetToRecorder) bool {
+	tasklog.Entry(req).Infoln(fmt.Sprintf("received new stop task: %s, roomTableId: %d, roomId: %s, sId: %s", req.Task.String(), req.GetRoomTableId(), req.GetRoomId(), req.GetRoomSid()))
+	_, span := tracing.Start(ctx, "stop task", tracing.TaskAttributes(req)...)
+	defer span.End()
 
-	var tasksToCheck []wemeet.RecordingTasks
+	var found bool
+	for _, task := range stopTargets(req) {
+		if process, ok := c.getAndDeleteRecorderInProgress(req.RoomTableId, task); ok && process != nil {
+			// need to start the process in goroutine otherwise will be delay in reply,
+			// and this will show error in the client.
+			// the session may be shared, so we'll only stop the output of this task
+			go process.DetachOutput(task, nil)
+			found = true
+		}
+	}
+
+	return found
+}
+
+// stopTargets returns the start tasks which will be stopped by req
+func stopTargets(req *wemeet.WeMeetToRecorder) []wemeet.RecordingTasks {
 	switch req.Task {
 	case wemeet.RecordingTasks_STOP_RECORDING:
-		tasksToCheck = append(tasksToCheck, wemeet.RecordingTasks_START_RECORDING)
+		return []wemeet.RecordingTasks{wemeet.RecordingTasks_START_RECORDING}
 	case wemeet.RecordingTasks_STOP_RTMP:
-		tasksToCheck = append(tasksToCheck, wemeet.RecordingTasks_START_RTMP)
+		return []wemeet.RecordingTasks{wemeet.RecordingTasks_START_RTMP}
 	case wemeet.RecordingTasks_STOP:
 		// For a general STOP, try to stop both recording and RTMP.
-		tasksToCheck = append(tasksToCheck, wemeet.RecordingTasks_START_RECORDING, wemeet.RecordingTasks_START_RTMP)
+		return []wemeet.RecordingTasks{wemeet.RecordingTasks_START_RECORDING, wemeet.RecordingTasks_START_RTMP}
 	}
+	return nil
+}
 
-	var found bool
-	for _, task := range tasksToCheck {
-		if process, ok := c.getAndDeleteRecorderInProgress(req.RoomTableId, task); ok && process != nil {
-			// need to start the process in goroutine otherwise will be delay in reply,
-			// and this will show error in the client
-			go process.Close(nil)
-			found = true
+// isStopTaskForMe returns true if any task stopped by req is running here
+func (c *RecorderController) isStopTaskForMe(req *wemeet.WeMeetToRecorder) bool {
+	for _, task := range stopTargets(req) {
+		if _, ok := c.recordersInProgress.Load(fmt.Sprintf("%d-%d", req.RoomTableId, task)); ok {
+			return true
 		}
 	}
-
-	return found
+	return false
 }
 
 // getAndDeleteRecorderInProgress atomically loads and deletes a recorder from the sync.Map.
@@ -57,19 +80,60 @@ func (c *RecorderController) getAndDeleteRecorderInProgress(tableId int64, task
 	return process, true
 }
 
-func (c *RecorderController) onAfterClose(req *wemeet.WeMeetToRecorder, filePath, fileName string, processErr error) {
-	log.Infoln(fmt.Sprintf("onAfterClose called for task: %s, roomTableId: %d, roomId: %s, sId: %s", req.Task.String(), req.GetRoomTableId(), req.GetRoomId(), req.GetRoomSid()))
+func (c *RecorderController) onAfterClose(req *wemeet.WeMeetToRecorder, output *recorder.Output, processErr error) {
+	tasklog.Entry(req).Infoln(fmt.Sprintf("onAfterClose called for task: %s, roomTableId: %d, roomId: %s, sId: %s", req.Task.String(), req.GetRoomTableId(), req.GetRoomId(), req.GetRoomSid()))
+	// the slot will be released before starting post-processing,
+	// so drain must wait for this too
+	c.postProcessing.Add(1)
+	defer c.postProcessing.Done()
+
+	ctx := c.releaseTask(req, output, processErr)
+	c.finishTask(ctx, req, output, processErr)
+}
+
+// releaseTask frees everything held by the task, so that the same task can be started again.
+// The returned context is for the spans of the work after the end.
+func (c *RecorderController) releaseTask(req *wemeet.WeMeetToRecorder, output *recorder.Output, processErr error) context.Context {
+	logger := tasklog.Entry(req)
+	// already open unless the task was reconciled
+	tasklog.Open(req, output.FilePath)
 
 	// Atomically remove from map. This handles cleanup for crashes or other unexpected closures.
 	// It's safe to call even if handleStopTask already removed it.
-	c.recordersInProgress.Delete(fmt.Sprintf("%d-%d", req.RoomTableId, req.Task))
+	id := fmt.Sprintf("%d-%d", req.RoomTableId, req.Task)
+	c.forgetRecorder(id)
+	if err := c.ns.DeleteTaskStatus(id); err != nil {
+		logger.Errorln(err)
+	}
+	c.taskReceivedAt.Delete(id)
+	// the same task can be started again, but not by a redelivery of the task which has ended
+	c.handledTasks.release(dedupKey(req), time.Duration(c.cnf.NatsInfo.Recorder.TaskStream.MaxTaskAge)*time.Second)
+	// the rest will be traced as the work after the end
+	ctx := c.endTaskTrace(req, processErr)
+	if processErr != nil {
+		metrics.TasksFailed.WithLabelValues(req.Task.String()).Inc()
+	} else {
+		metrics.TasksStopped.WithLabelValues(req.Task.String()).Inc()
+	}
+	if !output.StartedAt.IsZero() {
+		metrics.RecordingDuration.WithLabelValues(req.Task.String()).Observe(time.Since(output.StartedAt).Seconds())
+	}
 
-	// decrement process
-	err := c.ns.UpdateCurrentProgress(false)
-	if err != nil {
-		log.Errorln(err)
+	// the shared session keeps running for the attached output, so the slot goes with it
+	if c.admission.handOver(id, sharingTaskId(req)) {
+		logger.Infoln(fmt.Sprintf("slot of task: %s, roomTableId: %d was handed over to the attached output", req.Task.String(), req.GetRoomTableId()))
+	} else if counted, ok := c.admission.release(id); ok && counted {
+		// free the slot, and decrement process only if we had incremented it
+		if err := c.ns.UpdateCurrentProgress(false); err != nil {
+			logger.Errorln(err)
+		}
 	}
+	return ctx
+}
 
+// finishTask informs the server about the end of the task and processes the recording
+func (c *RecorderController) finishTask(ctx context.Context, req *wemeet.WeMeetToRecorder, output *recorder.Output, processErr error) {
+	logger := tasklog.Entry(req)
 	// notify to wemeet
 	toSend := &wemeet.RecorderToWeMeet{
 		From:        "recorder",
@@ -79,6 +143,8 @@ func (c *RecorderController) onAfterClose(req *wemeet.WeMeetToRecorder, filePath
 		RecordingId: req.RecordingId,
 		RecorderId:  req.RecorderId,
 		RoomTableId: req.RoomTableId,
+
+		RecordingVariant: recordingVariant(req, output.RecordingVariant),
 	}
 	if req.Task == wemeet.RecordingTasks_START_RTMP {
 		toSend.Task = wemeet.RecordingTasks_END_RTMP
@@ -87,62 +153,173 @@ func (c *RecorderController) onAfterClose(req *wemeet.WeMeetToRecorder, filePath
 		toSend.Status = false
 		toSend.Msg = processErr.Error()
 	}
-	log.Infoln(fmt.Sprintf("notifyToWeMeet with data: %+v", toSend))
+	if output.FfmpegRestarts > 0 {
+		toSend.Msg = fmt.Sprintf("%s, ffmpeg restarted %d times", toSend.Msg, output.FfmpegRestarts)
+	}
+	c.notify(ctx, req, toSend)
 
-	_, err = utils.NotifyToWeMeet(c.cnf.WeMeetInfo.Host, c.cnf.WeMeetInfo.ApiKey, c.cnf.WeMeetInfo.ApiSecret, toSend, nil)
-	if err != nil {
-		log.Errorln(err)
+	if req.Task != wemeet.RecordingTasks_START_RECORDING || len(output.FileNames) == 0 {
+		c.removeFromJournal(req)
+		tasklog.Close(req)
+		return
 	}
+	// END was sent, so after a crash from now on only post-processing will be needed
+	c.journalTask(req, journal.PhasePostProcessing, nil)
+	postProcessing := false
+	defer func() {
+		if !postProcessing {
+			c.removeFromJournal(req)
+			tasklog.Close(req)
+		}
+	}()
 
-	if req.Task == wemeet.RecordingTasks_START_RECORDING {
-		stat, err := os.Stat(path.Join(filePath, fileName))
+	if recorder.IsSegmentList(output.FileNames[0]) {
+		// the list may not exist if ffmpeg died before completing the first segment,
+		// so we'll check the segments directly
+		segments, err := recorder.ListSegments(output.FilePath, req.RecordingId)
+		if err != nil {
+			logger.Errorln(err)
+			return
+		}
+		if len(segments) > 0 {
+			postProcessing = true
+			c.startPostProcessing(ctx, req, output)
+		} else if processErr == nil {
+			logger.Errorln("avoiding postProcessRecording of ", path.Join(output.FilePath, output.FileNames[0]), "because no segment was found")
+		}
+		return
+	}
+
+	// every restart of ffmpeg writes a new part
+	var parts []string
+	for _, fileName := range output.FileNames {
+		stat, err := os.Stat(path.Join(output.FilePath, fileName))
 		if err != nil {
 			switch {
 			case os.IsNotExist(err) && processErr != nil:
 				// in this case, not found error is expected so, don't need to log
 				// otherwise will create confusion
 			default:
-				log.Errorln(err)
+				logger.Errorln(err)
 			}
-			return
+			continue
 		}
 		if stat.Size() > 0 {
-			go c.postProcessRecording(req, filePath, fileName)
+			parts = append(parts, fileName)
 		} else {
-			log.Errorln("avoiding postProcessRecording of ", path.Join(filePath, fileName), "file because of 0 size")
+			logger.Errorln("avoiding postProcessRecording of ", path.Join(output.FilePath, fileName), "file because of 0 size")
 		}
 	}
+	if len(parts) > 0 {
+		output.FileNames = parts
+		postProcessing = true
+		c.startPostProcessing(ctx, req, output)
+	}
 }
 
-func (c *RecorderController) postProcessRecording(req *wemeet.WeMeetToRecorder, filePath, currentFileName string) {
+// startPostProcessing runs postProcessRecording in background,
+// drain will wait for it before exiting
+func (c *RecorderController) startPostProcessing(ctx context.Context, req *wemeet.WeMeetToRecorder, output *recorder.Output) {
+	c.postProcessing.Add(1)
+	tasklog.Open(req, output.FilePath)
+	go func() {
+		defer c.postProcessing.Done()
+		defer tasklog.Close(req)
+		// even if it has failed, we'll keep the files for manual recovery
+		defer c.removeFromJournal(req)
+		start := time.Now()
+		ctx, span := tracing.Start(ctx, "post-processing", tracing.TaskAttributes(req)...)
+		c.postProcessRecording(ctx, req, output)
+		span.End()
+		metrics.PostProcessingDuration.Observe(time.Since(start).Seconds())
+	}()
+}
+
+func (c *RecorderController) postProcessRecording(ctx context.Context, req *wemeet.WeMeetToRecorder, output *recorder.Output) {
+	logger := tasklog.Entry(req)
+	filePath := output.FilePath
+	currentFileName := output.FileNames[0]
 	finalFileName := fmt.Sprintf("%s.mp4", req.RecordingId)
+	if output.AudioOnly {
+		// .m4a or .ogg
+		finalFileName = req.RecordingId + path.Ext(currentFileName)
+	}
+	// will be added to the message of the notification
+	var notes []string
+	// moov atom must be at the start of the final mp4
+	expectFastStart := false
+
+	switch {
+	case recorder.IsSegmentList(currentFileName):
+		_, span := tracing.Start(ctx, "concat segments")
+		rawFileName, skipped, err := c.concatSegments(req, filePath)
+		tracing.End(span, err)
+		if err != nil {
+			logger.Errorln(fmt.Sprintf("keeping the segments of recordingId: %s because of error: %s", req.RecordingId, err.Error()))
+			metrics.PostProcessingFailures.WithLabelValues("concat_segments").Inc()
+			segments, _ := recorder.ListSegments(filePath, req.RecordingId)
+			c.notifyPostProcessingFailed(ctx, req, output, err, segments)
+			return
+		}
+		currentFileName = rawFileName
+		// concat always moves the moov atom of mp4 & m4a
+		expectFastStart = isMp4(rawFileName)
+		if len(skipped) > 0 {
+			notes = append(notes, fmt.Sprintf("skipped %d missing or corrupt segments: %s", len(skipped), strings.Join(skipped, ", ")))
+		}
+	case len(output.FileNames) > 1:
+		_, span := tracing.Start(ctx, "concat parts")
+		rawFileName, skipped, err := c.concatParts(req, filePath, output.FileNames)
+		tracing.End(span, err)
+		if err != nil {
+			logger.Errorln(fmt.Sprintf("keeping the parts of recordingId: %s because of error: %s", req.RecordingId, err.Error()))
+			metrics.PostProcessingFailures.WithLabelValues("concat_parts").Inc()
+			c.notifyPostProcessingFailed(ctx, req, output, err, existingFiles(filePath, output.FileNames))
+			return
+		}
+		currentFileName = rawFileName
+		// concat always moves the moov atom of mp4 & m4a
+		expectFastStart = isMp4(rawFileName)
+		if len(skipped) > 0 {
+			notes = append(notes, fmt.Sprintf("skipped %d corrupt parts: %s", len(skipped), strings.Join(skipped, ", ")))
+		}
+	}
+	if output.FfmpegRestarts > 0 {
+		notes = append(notes, fmt.Sprintf("ffmpeg restarted %d times", output.FfmpegRestarts))
+	}
 
-	if c.cnf.Recorder.PostMp4Convert {
+	// audio is already encoded in the final format, so we'll only rename it
+	if c.cnf.Recorder.PostMp4Convert && !output.AudioOnly {
 		var args []string
 		args = append(args, strings.Split(c.cnf.FfmpegSettings.PostRecording.PreInput, " ")...)
 		args = append(args, "-i", path.Join(filePath, currentFileName))
 		args = append(args, strings.Split(c.cnf.FfmpegSettings.PostRecording.PostInput, " ")...)
 		args = append(args, path.Join(filePath, finalFileName))
-		log.Infoln("starting post recording ffmpeg process with args:", strings.Join(args, " "))
+		logger.Infoln("starting post recording ffmpeg process with args:", strings.Join(args, " "))
 
+		_, span := tracing.Start(ctx, "convert")
 		_, err := exec.Command("ffmpeg", args...).CombinedOutput()
+		tracing.End(span, err)
 		if err != nil {
-			log.Errorln(fmt.Sprintf("keeping the raw file: %s as output because of error from ffmpeg: %s", currentFileName, err.Error()))
+			logger.Errorln(fmt.Sprintf("keeping the raw file: %s as output because of error from ffmpeg: %s", currentFileName, err.Error()))
+			metrics.PostProcessingFailures.WithLabelValues("convert").Inc()
 			// remove the new file
 			_ = os.Remove(path.Join(filePath, finalFileName))
 			// keep the old file as output
 			finalFileName = currentFileName
 		} else {
+			expectFastStart = strings.Contains(c.cnf.FfmpegSettings.PostRecording.PostInput, "faststart")
 			err = os.Remove(path.Join(filePath, currentFileName))
 			if err != nil {
-				log.Errorln(err)
+				logger.Errorln(err)
 			}
 		}
 	} else {
 		// just rename
 		err := os.Rename(path.Join(filePath, currentFileName), path.Join(filePath, finalFileName))
 		if err != nil {
-			log.Errorln(fmt.Sprintf("keeping the raw file: %s as output because of error during rename: %s", currentFileName, err.Error()))
+			logger.Errorln(fmt.Sprintf("keeping the raw file: %s as output because of error during rename: %s", currentFileName, err.Error()))
+			metrics.PostProcessingFailures.WithLabelValues("rename").Inc()
 			// keep the old file as output
 			finalFileName = currentFileName
 		}
@@ -151,45 +328,45 @@ func (c *RecorderController) postProcessRecording(req *wemeet.WeMeetToRecorder,
 	outputFilePath := path.Join(filePath, finalFileName)
 	stat, err := os.Stat(outputFilePath)
 	if err != nil {
-		log.Errorln(err)
+		logger.Errorln(err)
+		metrics.PostProcessingFailures.WithLabelValues("stat").Inc()
 		return
 	}
 
 	size := float32(stat.Size()) / 1000000.0
-	var relativePath string
 
-	// To robustly calculate the relative path, first ensure the base path is absolute.
-	// This prevents errors when the configured path is relative (e.g., "./recordings").
-	basePath, err := filepath.Abs(c.cnf.Recorder.CopyToPath.MainPath)
+	_, span := tracing.Start(ctx, "validate")
+	info := c.validateRecording(req.RecordingId, outputFilePath, output.AudioOnly, expectFastStart)
+	mediaInfoFile, err := writeMediaInfo(outputFilePath, info)
 	if err != nil {
-		log.WithError(err).Errorf("could not determine absolute path for main_path '%s', falling back to string trimming", c.cnf.Recorder.CopyToPath.MainPath)
-		relativePath = strings.TrimPrefix(outputFilePath, c.cnf.Recorder.CopyToPath.MainPath)
-	} else {
-		// Now that we have an absolute base path, we can safely calculate the relative path.
-		relativePath, err = filepath.Rel(basePath, outputFilePath)
-		if err != nil {
-			log.WithError(err).Errorf("could not make path relative for %s", outputFilePath)
-			relativePath = strings.TrimPrefix(outputFilePath, basePath)
-		}
+		logger.Errorln(err)
+	}
+	msg := "success"
+	if !info.Valid {
+		// the file is kept, but it must not be reported as a good recording
+		logger.Errorln(fmt.Sprintf("recording: %s failed validation: %s", finalFileName, strings.Join(info.Problems, ", ")))
+		metrics.PostProcessingFailures.WithLabelValues("validate").Inc()
+		msg = "validation failed: " + strings.Join(info.Problems, ", ")
+		span.SetStatus(codes.Error, msg)
 	}
+	span.End()
+	msg = strings.Join(append([]string{msg, info.summary()}, notes...), ", ")
+	relativePath := c.relativeRecordingPath(req, outputFilePath)
 
 	toSend := &wemeet.RecorderToWeMeet{
 		From:        "recorder",
-		Status:      true,
+		Status:      info.Valid,
 		Task:        wemeet.RecordingTasks_RECORDING_PROCEEDED,
-		Msg:         "success",
+		Msg:         msg,
 		RecordingId: req.RecordingId,
 		RecorderId:  req.RecorderId,
 		RoomTableId: req.RoomTableId,
 		FilePath:    relativePath,
 		FileSize:    float32(int(size*100)) / 100,
-	}
-	log.Infoln(fmt.Sprintf("notifyToWeMeet with data: %+v", toSend))
 
-	_, err = utils.NotifyToWeMeet(c.cnf.WeMeetInfo.Host, c.cnf.WeMeetInfo.ApiKey, c.cnf.WeMeetInfo.ApiSecret, toSend, nil)
-	if err != nil {
-		log.Errorln(err)
+		RecordingVariant: recordingVariant(req, output.RecordingVariant),
 	}
+	c.notify(ctx, req, toSend)
 
 	// post-processing scripts
 	if len(c.cnf.Recorder.PostProcessingScripts) == 0 {
@@ -204,17 +381,68 @@ func (c *RecorderController) postProcessRecording(req *wemeet.WeMeetToRecorder,
 		"file_path":     path.Join(filePath, finalFileName), // this will be the full path of the file
 		"file_size":     size,
 		"recorder_id":   req.GetRecorderId(),
+		"variant":       output.RecordingVariant.String(),
+		"valid":         info.Valid,
+		"media_info":    mediaInfoFile,
 	}
 	marshal, err := json.Marshal(data)
 	if err != nil {
-		log.Errorln(err)
+		logger.Errorln(err)
 		return
 	}
 
 	for _, script := range c.cnf.Recorder.PostProcessingScripts {
+		_, span := tracing.Start(ctx, "post-processing script", attribute.String("script", script))
 		_, err := exec.Command("/bin/sh", script, string(marshal)).CombinedOutput()
+		tracing.End(span, err)
 		if err != nil {
-			log.Errorln(err)
+			logger.Errorln(err)
+			metrics.PostProcessingFailures.WithLabelValues("script").Inc()
 		}
 	}
 }
+
+// relativeRecordingPath returns file relative to main_path, as it will be stored by the server
+func (c *RecorderController) relativeRecordingPath(req *wemeet.WeMeetToRecorder, file string) string {
+	logger := tasklog.Entry(req)
+	var relativePath string
+
+	// To robustly calculate the relative path, first ensure the base path is absolute.
+	// This prevents errors when the configured path is relative (e.g., "./recordings").
+	basePath, err := filepath.Abs(c.cnf.Recorder.CopyToPath.MainPath)
+	if err != nil {
+		logger.WithError(err).Errorf("could not determine absolute path for main_path '%s', falling back to string trimming", c.cnf.Recorder.CopyToPath.MainPath)
+		relativePath = strings.TrimPrefix(file, c.cnf.Recorder.CopyToPath.MainPath)
+	} else {
+		// Now that we have an absolute base path, we can safely calculate the relative path.
+		relativePath, err = filepath.Rel(basePath, file)
+		if err != nil {
+			logger.WithError(err).Errorf("could not make path relative for %s", file)
+			relativePath = strings.TrimPrefix(file, basePath)
+		}
+	}
+	return relativePath
+}
+
+// notifyPostProcessingFailed informs the server that the recording couldn't be processed,
+// kept files are left in the dir of the recording for manual recovery
+func (c *RecorderController) notifyPostProcessingFailed(ctx context.Context, req *wemeet.WeMeetToRecorder, output *recorder.Output, err error, kept []string) {
+	var paths []string
+	for _, f := range kept {
+		paths = append(paths, c.relativeRecordingPath(req, path.Join(output.FilePath, f)))
+	}
+
+	toSend := &wemeet.RecorderToWeMeet{
+		From:        "recorder",
+		Status:      false,
+		Task:        wemeet.RecordingTasks_RECORDING_PROCEEDED,
+		Msg:         fmt.Sprintf("post-processing failed: %s, kept files: %s", err.Error(), strings.Join(paths, ", ")),
+		RecordingId: req.RecordingId,
+		RecorderId:  req.RecorderId,
+		RoomTableId: req.RoomTableId,
+		FilePath:    c.relativeRecordingPath(req, output.FilePath),
+
+		RecordingVariant: recordingVariant(req, output.RecordingVariant),
+	}
+	c.notify(ctx, req, toSend)
+}
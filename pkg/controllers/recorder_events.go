@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	natsservice "github.com/retawsolit/WeMeet-recorder/pkg/services/nats"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// type of the notifications which were sent with status false
+	eventTaskFailed = "failed"
+	eventsQueueSize = 256
+)
+
+var eventSeq atomic.Uint64
+
+// startEvents will make sure the stream exists & start the publisher,
+// events will be published in order of creation
+func (c *RecorderController) startEvents() error {
+	if err := c.ns.CreateEventStream(); err != nil {
+		return err
+	}
+
+	c.events = make(chan *natsservice.RecorderEvent, eventsQueueSize)
+	go func() {
+		for e := range c.events {
+			if err := c.ns.PublishEvent(e); err != nil {
+				log.Errorln(fmt.Sprintf("failed to publish event: %s for roomTableId: %d, error: %s", e.Type, e.RoomTableId, err.Error()))
+			}
+		}
+	}()
+	return nil
+}
+
+// onEvent publishes the internal events of the recorder
+func (c *RecorderController) onEvent(req *wemeet.WeMeetToRecorder, event string, details map[string]string) {
+	c.publishEvent(req, &natsservice.RecorderEvent{
+		Type:    event,
+		Details: details,
+	})
+}
+
+// publishNotification publishes the notification which was sent to the server
+func (c *RecorderController) publishNotification(req *wemeet.WeMeetToRecorder, toSend *wemeet.RecorderToWeMeet) {
+	if c.events == nil {
+		return
+	}
+	payload, err := protojson.Marshal(toSend)
+	if err != nil {
+		tasklog.Entry(req).Errorln(err)
+		return
+	}
+
+	e := &natsservice.RecorderEvent{
+		Type:         strings.ToLower(toSend.Task.String()),
+		Status:       &toSend.Status,
+		Msg:          toSend.Msg,
+		Notification: payload,
+	}
+	if !toSend.Status {
+		e.Type = eventTaskFailed
+	}
+	c.publishEvent(req, e)
+}
+
+func (c *RecorderController) publishEvent(req *wemeet.WeMeetToRecorder, e *natsservice.RecorderEvent) {
+	if c.events == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	e.Id = fmt.Sprintf("%s-%d-%d", c.cnf.Recorder.Id, now.UnixNano(), eventSeq.Add(1))
+	e.Time = now
+	e.RecorderId = c.cnf.Recorder.Id
+	e.RoomId = req.GetRoomId()
+	e.RoomTableId = req.GetRoomTableId()
+	e.RecordingId = req.GetRecordingId()
+	e.Task = req.Task.String()
+
+	select {
+	case c.events <- e:
+	default:
+		// never block the recorder because of nats
+		tasklog.Entry(req).Errorln(fmt.Sprintf("events queue is full, dropping event: %s for roomTableId: %d", e.Type, e.RoomTableId))
+	}
+}
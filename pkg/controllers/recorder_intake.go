@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/retawsolit/WeMeet-recorder/pkg/metrics"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tracing"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+// handleTask will process a task received either from core nats or from the task stream.
+// It returns nil if nothing should be responded, e.g. the task is for another recorder.
+func (c *RecorderController) handleTask(ctx context.Context, req *wemeet.WeMeetToRecorder) *wemeet.CommonResponse {
+	if req.From != "wemeet" {
+		return nil
+	}
+	if !c.cnf.NatsInfo.Recorder.TaskStream.Enabled || req.GetRecordingId() == "" {
+		return c.processTask(ctx, req)
+	}
+
+	// with task stream, the same message will be received twice
+	key := dedupKey(req)
+	entry, first := c.handledTasks.begin(key)
+	if !first {
+		// wait if it's still being processed, so both will get the same response
+		<-entry.done
+		tasklog.Entry(req).Infoln(fmt.Sprintf("ignoring duplicate task: %s, roomTableId: %d, recordingId: %s", req.Task.String(), req.GetRoomTableId(), req.GetRecordingId()))
+		return entry.res
+	}
+
+	res := c.processTask(ctx, req)
+	entry.finish(res)
+	if res == nil || !res.Status {
+		// a retry must be processed again
+		c.handledTasks.forget(key, entry)
+	}
+	return res
+}
+
+// dedupKey is the key of req in handledTasks
+func dedupKey(req *wemeet.WeMeetToRecorder) string {
+	return fmt.Sprintf("%s-%d", req.GetRecordingId(), req.Task)
+}
+
+func (c *RecorderController) processTask(ctx context.Context, req *wemeet.WeMeetToRecorder) *wemeet.CommonResponse {
+	switch req.Task {
+	case wemeet.RecordingTasks_START_RECORDING,
+		wemeet.RecordingTasks_START_RTMP:
+		if !c.isStartTaskForMe(req) {
+			return nil
+		}
+		if err := c.validateTask(req); err != nil {
+			return c.rejectTask(req, err)
+		}
+		res := &wemeet.CommonResponse{
+			Status: true,
+			Msg:    "success",
+		}
+		err := c.handleStartTask(ctx, req)
+		if err != nil {
+			res.Status = false
+			res.Msg = err.Error()
+		}
+		return res
+	case wemeet.RecordingTasks_STOP_RECORDING,
+		wemeet.RecordingTasks_STOP_RTMP,
+		wemeet.RecordingTasks_STOP:
+		// only the recorder running the task should reply
+		if !c.isStopTaskForMe(req) {
+			return nil
+		}
+		if err := c.validateTask(req); err != nil {
+			return c.rejectTask(req, err)
+		}
+		ok := c.handleStopTask(ctx, req)
+		if !ok {
+			return nil
+		}
+		// then the process was in this recorder
+		return &wemeet.CommonResponse{
+			Status: true,
+			Msg:    "success",
+		}
+	default:
+		tasklog.Entry(req).Errorln(fmt.Sprintf("invalid task %s received", req.Task.String()))
+	}
+
+	return nil
+}
+
+func (c *RecorderController) isStartTaskForMe(req *wemeet.WeMeetToRecorder) bool {
+	return (req.Task == wemeet.RecordingTasks_START_RECORDING || req.Task == wemeet.RecordingTasks_START_RTMP) &&
+		req.RecorderId == c.cnf.Recorder.Id
+}
+
+func (c *RecorderController) rejectTask(req *wemeet.WeMeetToRecorder, err error) *wemeet.CommonResponse {
+	tasklog.Entry(req).Warnln(fmt.Sprintf("rejecting task: %s, roomTableId: %d, reason: %s", req.Task.String(), req.GetRoomTableId(), err.Error()))
+	metrics.TasksFailed.WithLabelValues(req.Task.String()).Inc()
+	return &wemeet.CommonResponse{
+		Status: false,
+		Msg:    err.Error(),
+	}
+}
+
+// consumeTaskStream will receive the tasks stored while this recorder
+// wasn't connected. Every message will be acked after the task was accepted or rejected,
+// otherwise it will be redelivered.
+func (c *RecorderController) consumeTaskStream() error {
+	cons, err := c.ns.CreateTaskConsumer()
+	if err != nil {
+		return err
+	}
+	maxAge := time.Duration(c.cnf.NatsInfo.Recorder.TaskStream.MaxTaskAge) * time.Second
+	// stream can deliver a task later than core nats
+	authMaxAge := max(maxAge, time.Duration(c.cnf.NatsInfo.Recorder.TaskAuth.MaxAge)*time.Second)
+
+	cc, err := cons.Consume(func(msg jetstream.Msg) {
+		req := new(wemeet.WeMeetToRecorder)
+		if err := proto.Unmarshal(msg.Data(), req); err != nil {
+			log.Errorln(err)
+			// it will never be valid
+			_ = msg.Term()
+			return
+		}
+
+		if req.Task == wemeet.RecordingTasks_START_RECORDING || req.Task == wemeet.RecordingTasks_START_RTMP {
+			if meta, err := msg.Metadata(); err == nil && time.Since(meta.Timestamp) > maxAge {
+				// the server has already given up on it
+				tasklog.Entry(req).Warnln(fmt.Sprintf("ignoring stale task: %s, roomTableId: %d, published at: %s", req.Task.String(), req.GetRoomTableId(), meta.Timestamp.String()))
+				_ = msg.Ack()
+				return
+			}
+		}
+
+		ctx, span := tracing.Start(tracing.FromNatsHeader(msg.Headers()), "nats stream receive", tracing.TaskAttributes(req)...)
+		if err := c.taskAuth.authorize(req, msg.Data(), msg.Headers(), intakeStream, authMaxAge); err == nil {
+			c.handleTask(ctx, req)
+		} else {
+			span.RecordError(err)
+		}
+		span.End()
+		if err := msg.Ack(); err != nil {
+			log.Errorln(err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	c.taskStreamCtx = cc
+	return nil
+}
+
+// taskDedup remembers the tasks handled recently by their recordingId & task
+type taskDedup struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]*dedupEntry
+	now     func() time.Time
+}
+
+type dedupEntry struct {
+	at time.Time
+	// it will be forgotten after this
+	expiresAt time.Time
+	res       *wemeet.CommonResponse
+	done      chan struct{}
+}
+
+func newTaskDedup(ttl time.Duration) *taskDedup {
+	return &taskDedup{
+		ttl:     ttl,
+		entries: make(map[string]*dedupEntry),
+		now:     time.Now,
+	}
+}
+
+// begin returns true if key wasn't seen before,
+// in that case entry.finish must be called after processing
+func (d *taskDedup) begin(key string) (*dedupEntry, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.now()
+	for k, e := range d.entries {
+		if now.After(e.expiresAt) {
+			delete(d.entries, k)
+		}
+	}
+
+	if e, ok := d.entries[key]; ok {
+		return e, false
+	}
+	e := &dedupEntry{at: now, expiresAt: now.Add(d.ttl), done: make(chan struct{})}
+	d.entries[key] = e
+	return e, true
+}
+
+// forget removes key, so that the task will be processed again.
+// If e isn't nil, key will be removed only if it still belongs to e.
+func (d *taskDedup) forget(key string, e *dedupEntry) {
+	d.Lock()
+	defer d.Unlock()
+	if cur, ok := d.entries[key]; ok && (e == nil || cur == e) {
+		delete(d.entries, key)
+	}
+}
+
+// release will forget key once it's older than maxAge, so that a redelivered task
+// can't be processed again while it's still accepted, but the same task can be sent again later
+func (d *taskDedup) release(key string, maxAge time.Duration) {
+	d.Lock()
+	defer d.Unlock()
+	e, ok := d.entries[key]
+	if !ok {
+		return
+	}
+	if expiresAt := e.at.Add(maxAge); expiresAt.Before(e.expiresAt) {
+		e.expiresAt = expiresAt
+	}
+	if d.now().After(e.expiresAt) {
+		delete(d.entries, key)
+	}
+}
+
+func (e *dedupEntry) finish(res *wemeet.CommonResponse) {
+	e.res = res
+	close(e.done)
+}
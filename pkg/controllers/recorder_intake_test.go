@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+// fakeClock is used as now of taskDedup
+type fakeClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) add(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestDedup(ttl time.Duration) (*taskDedup, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	d := newTaskDedup(ttl)
+	d.now = clock.now
+	return d, clock
+}
+
+func TestTaskDedupBeginForget(t *testing.T) {
+	d, clock := newTestDedup(time.Hour)
+	success := &wemeet.CommonResponse{Status: true, Msg: "success"}
+
+	e, first := d.begin("rec1-0")
+	if !first {
+		t.Fatal("first begin must be first")
+	}
+	dup, first := d.begin("rec1-0")
+	if first || dup != e {
+		t.Fatal("second begin must return the same entry")
+	}
+	e.finish(success)
+	<-dup.done
+	if dup.res != success {
+		t.Fatal("duplicate must get the same response")
+	}
+
+	// forget of another entry must not remove it
+	d.forget("rec1-0", &dedupEntry{})
+	if _, first := d.begin("rec1-0"); first {
+		t.Fatal("entry was removed by forget of another entry")
+	}
+	d.forget("rec1-0", e)
+	if _, first := d.begin("rec1-0"); !first {
+		t.Fatal("entry wasn't removed by forget")
+	}
+
+	// every entry expires after ttl
+	clock.add(2 * time.Hour)
+	if _, first := d.begin("rec1-0"); !first {
+		t.Fatal("entry didn't expire after ttl")
+	}
+}
+
+func TestTaskDedupRedeliveredStartAfterClose(t *testing.T) {
+	maxTaskAge := 120 * time.Second
+	start := &wemeet.WeMeetToRecorder{Task: wemeet.RecordingTasks_START_RECORDING, RecordingId: "rec1"}
+	key := dedupKey(start)
+
+	tests := []struct {
+		name string
+		// time between the start & the end of the recording
+		ran time.Duration
+		// time between the end & the redelivery
+		after     time.Duration
+		wantFirst bool
+	}{
+		{name: "redelivered while the task is still accepted", ran: 10 * time.Second, after: time.Second, wantFirst: false},
+		{name: "redelivered just before max_task_age", ran: 10 * time.Second, after: 109 * time.Second, wantFirst: false},
+		{name: "sent again after max_task_age", ran: 10 * time.Second, after: 111 * time.Second, wantFirst: true},
+		{name: "ended after max_task_age", ran: time.Hour - time.Minute, after: 0, wantFirst: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, clock := newTestDedup(time.Hour)
+			e, _ := d.begin(key)
+			e.finish(&wemeet.CommonResponse{Status: true})
+
+			clock.add(tt.ran)
+			// recording was closed
+			d.release(key, maxTaskAge)
+
+			clock.add(tt.after)
+			if _, first := d.begin(key); first != tt.wantFirst {
+				t.Fatalf("begin() first = %v, want %v", first, tt.wantFirst)
+			}
+		})
+	}
+}
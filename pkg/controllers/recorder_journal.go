@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/journal"
+	"github.com/retawsolit/WeMeet-recorder/pkg/recorder"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var errRecorderRestarted = errors.New("recorder was restarted while the task was running")
+
+// journalTask will persist the latest state of the task, state can be nil
+// if only the phase need to be changed
+func (c *RecorderController) journalTask(req *wemeet.WeMeetToRecorder, phase string, state *recorder.SessionState) {
+	c.journalMu.Lock()
+	defer c.journalMu.Unlock()
+	c.writeJournal(req, phase, state, true)
+}
+
+// writeJournal must be called with journalMu held. Without create,
+// only an existing entry in the same phase will be updated.
+func (c *RecorderController) writeJournal(req *wemeet.WeMeetToRecorder, phase string, state *recorder.SessionState, create bool) {
+	id := fmt.Sprintf("%d-%d", req.RoomTableId, req.Task)
+
+	e, err := c.journal.Get(id)
+	if err != nil {
+		tasklog.Entry(req).Errorln(err)
+	}
+	if e == nil {
+		if !create {
+			return
+		}
+		e = &journal.Entry{
+			Id:        id,
+			StartedAt: time.Now().UTC(),
+		}
+		if e.Request, err = protojson.Marshal(req); err != nil {
+			tasklog.Entry(req).Errorln(err)
+			return
+		}
+	} else if !create && e.Phase != phase {
+		return
+	}
+	e.Phase = phase
+
+	if state != nil {
+		e.FilePath = state.FilePath
+		e.FileNames = state.FileNames
+		e.AudioOnly = state.AudioOnly
+		e.Variant = int32(state.RecordingVariant)
+		e.PulseSinkId = state.PulseSinkId
+		e.PulseSinkName = state.PulseSinkName
+		e.Processes = nil
+		for _, p := range state.Processes {
+			e.Processes = append(e.Processes, journal.Process{Name: p.Name, Pid: p.Pid, Match: p.Match})
+		}
+	}
+
+	if err := c.journal.Put(e); err != nil {
+		tasklog.Entry(req).Errorln(err)
+	}
+}
+
+func (c *RecorderController) removeFromJournal(req *wemeet.WeMeetToRecorder) {
+	c.journalMu.Lock()
+	defer c.journalMu.Unlock()
+	if err := c.journal.Remove(fmt.Sprintf("%d-%d", req.RoomTableId, req.Task)); err != nil {
+		tasklog.Entry(req).Errorln(err)
+	}
+}
+
+// forgetRecorder removes the task from recordersInProgress, holding journalMu
+// so that a late state report can't pass its check in onStateChange afterwards
+func (c *RecorderController) forgetRecorder(id string) {
+	c.journalMu.Lock()
+	defer c.journalMu.Unlock()
+	c.recordersInProgress.Delete(id)
+}
+
+func (c *RecorderController) onStateChange(req *wemeet.WeMeetToRecorder, state *recorder.SessionState) {
+	c.journalMu.Lock()
+	defer c.journalMu.Unlock()
+
+	v, ok := c.recordersInProgress.Load(fmt.Sprintf("%d-%d", req.RoomTableId, req.Task))
+	if !ok {
+		// already stopped, late report must not add it again
+		return
+	}
+	if r, ok := v.(*recorder.Recorder); ok && !r.HasOutput(req) {
+		// from a previous run of the same task
+		return
+	}
+	c.writeJournal(req, journal.PhaseRunning, state, false)
+}
+
+// reconcileJournal will clean up the tasks which were running when this recorder
+// was killed. CURRENT_PROGRESS was already reset by AddRecorder, so we only need to
+// kill the leftovers, inform the server & process the recordings.
+func (c *RecorderController) reconcileJournal() {
+	entries, errs := c.journal.List()
+	for _, err := range errs {
+		log.Errorln("journal:", err)
+	}
+
+	for _, e := range entries {
+		req := new(wemeet.WeMeetToRecorder)
+		if err := protojson.Unmarshal(e.Request, req); err != nil {
+			log.Errorln(fmt.Sprintf("removing unreadable journal entry: %s, error: %s", e.Id, err.Error()))
+			_ = c.journal.Remove(e.Id)
+			continue
+		}
+		tasklog.Entry(req).Warnln(fmt.Sprintf("reconciling task: %s, roomTableId: %d, recordingId: %s, phase: %s, started at: %s", req.Task.String(), req.GetRoomTableId(), req.GetRecordingId(), e.Phase, e.StartedAt.String()))
+
+		for _, p := range e.Processes {
+			killed, err := p.KillIfRunning()
+			if err != nil {
+				tasklog.Entry(req).Errorln(fmt.Sprintf("failed to kill leftover %s with pid: %d, error: %s", p.Name, p.Pid, err.Error()))
+			} else if killed {
+				tasklog.Entry(req).Infoln(fmt.Sprintf("killed leftover %s with pid: %d", p.Name, p.Pid))
+			}
+		}
+		if _, err := journal.UnloadPulseSink(e.PulseSinkId, e.PulseSinkName); err != nil {
+			tasklog.Entry(req).Errorln(fmt.Sprintf("failed to unload leftover pulse sink: %s, error: %s", e.PulseSinkName, err.Error()))
+		}
+		c.removeLeftoverHls(req)
+
+		output := &recorder.Output{
+			FilePath:         e.FilePath,
+			FileNames:        e.FileNames,
+			AudioOnly:        e.AudioOnly,
+			RecordingVariant: wemeet.CloudRecordingVariants(e.Variant),
+		}
+
+		if e.Phase == journal.PhasePostProcessing {
+			// END was already sent
+			output.FileNames = existingFiles(output.FilePath, output.FileNames)
+			if len(output.FileNames) == 0 {
+				tasklog.Entry(req).Errorln(fmt.Sprintf("no file left to process for recordingId: %s", req.GetRecordingId()))
+				_ = c.journal.Remove(e.Id)
+				continue
+			}
+			c.startPostProcessing(context.Background(), req, output)
+			continue
+		}
+
+		// must be done before accepting new tasks, otherwise
+		// a new task with the same id could be released by this
+		ctx := c.releaseTask(req, output, errRecorderRestarted)
+		c.postProcessing.Add(1)
+		// notifying may take time because of retries
+		go func() {
+			defer c.postProcessing.Done()
+			c.finishTask(ctx, req, output, errRecorderRestarted)
+		}()
+	}
+}
+
+// removeLeftoverHls removes the local hls of the task as the output would have done,
+// so nobody can watch it after the crash
+func (c *RecorderController) removeLeftoverHls(req *wemeet.WeMeetToRecorder) {
+	if req.Task != wemeet.RecordingTasks_START_RTMP || !c.cnf.HlsServer.Enabled {
+		return
+	}
+	if !safeIdRegex.MatchString(req.GetRoomId()) || !safeIdRegex.MatchString(req.GetRecordingId()) {
+		return
+	}
+
+	dir := recorder.LocalHlsDir(c.cnf, req.GetRoomId(), req.GetRecordingId())
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		tasklog.Entry(req).Errorln(fmt.Sprintf("failed to remove leftover local hls dir %s, error: %s", dir, err.Error()))
+		return
+	}
+	tasklog.Entry(req).Infoln(fmt.Sprintf("removed leftover local hls dir %s", dir))
+}
+
+// existingFiles returns the files still on the disk, segment list
+// will be kept because segments will be checked directly
+func existingFiles(filePath string, fileNames []string) []string {
+	var files []string
+	for _, f := range fileNames {
+		if recorder.IsSegmentList(f) {
+			files = append(files, f)
+			continue
+		}
+		if _, err := os.Stat(path.Join(filePath, f)); err == nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
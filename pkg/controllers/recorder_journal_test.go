@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+func TestRemoveLeftoverHls(t *testing.T) {
+	tests := []struct {
+		name        string
+		task        wemeet.RecordingTasks
+		hlsEnabled  bool
+		recordingId string
+		removed     bool
+	}{
+		{name: "rtmp task", task: wemeet.RecordingTasks_START_RTMP, hlsEnabled: true, recordingId: "rec1", removed: true},
+		{name: "hls_server disabled", task: wemeet.RecordingTasks_START_RTMP, recordingId: "rec1"},
+		{name: "recording task", task: wemeet.RecordingTasks_START_RECORDING, hlsEnabled: true, recordingId: "rec1"},
+		{name: "unsafe recording id", task: wemeet.RecordingTasks_START_RTMP, hlsEnabled: true, recordingId: ".."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cnf := new(config.AppConfig)
+			cnf.HlsServer.Enabled = tt.hlsEnabled
+			cnf.HlsServer.WorkDir = t.TempDir()
+			c := &RecorderController{cnf: cnf}
+
+			// the playlist of another recording of the room must be kept
+			other := path.Join(cnf.HlsServer.WorkDir, "room1", "rec2")
+			dir := path.Join(cnf.HlsServer.WorkDir, "room1", "rec1")
+			for _, d := range []string{dir, other} {
+				if err := os.MkdirAll(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path.Join(d, "index.m3u8"), []byte("#EXTM3U\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c.removeLeftoverHls(&wemeet.WeMeetToRecorder{Task: tt.task, RoomId: "room1", RecordingId: tt.recordingId})
+
+			if _, err := os.Stat(dir); os.IsNotExist(err) != tt.removed {
+				t.Fatalf("removed: %t, want %t", os.IsNotExist(err), tt.removed)
+			}
+			if _, err := os.Stat(other); err != nil {
+				t.Fatal("another recording was removed:", err)
+			}
+		})
+	}
+}
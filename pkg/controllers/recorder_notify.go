@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/metrics"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tracing"
+	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// notify is the only way to send notifications to wemeet.
+// Those will be delivered from the outbox, so nothing will be lost during an outage.
+// The same will be published as event too.
+func (c *RecorderController) notify(ctx context.Context, req *wemeet.WeMeetToRecorder, toSend *wemeet.RecorderToWeMeet) {
+	tasklog.Entry(req).Infoln(fmt.Sprintf("notifyToWeMeet with data: %+v", toSend))
+	_, span := tracing.Start(ctx, "notify", attribute.String("notify.task", toSend.Task.String()), attribute.Bool("notify.status", toSend.Status))
+	defer span.End()
+	c.publishNotification(req, toSend)
+
+	// order matters only within a recording
+	key := toSend.GetRecordingId()
+	if key == "" {
+		key = fmt.Sprintf("%d", toSend.GetRoomTableId())
+	}
+
+	err := c.outbox.Enqueue(key, toSend)
+	if err == nil {
+		return
+	}
+
+	tasklog.Entry(req).Errorln(fmt.Sprintf("failed to add notification in outbox, sending directly, error: %s", err.Error()))
+	if _, err := c.sendNotification(context.Background(), toSend); err != nil {
+		tasklog.Entry(req).Errorln(err)
+	}
+}
+
+// sendNotification makes a single attempt, outbox will take care of the retries
+func (c *RecorderController) sendNotification(ctx context.Context, toSend *wemeet.RecorderToWeMeet) (int, error) {
+	retryMax := uint(0)
+	status, err := utils.NotifyToWeMeet(ctx, c.cnf.WeMeetInfo.Host, c.cnf.WeMeetInfo.ApiKey, c.cnf.WeMeetInfo.ApiSecret, toSend, &retryMax)
+
+	code := fmt.Sprintf("%d", status)
+	metrics.NotifyAttempts.WithLabelValues(code).Inc()
+	if err != nil || status >= http.StatusBadRequest {
+		metrics.NotifyFailures.WithLabelValues(code).Inc()
+	}
+	return status, err
+}
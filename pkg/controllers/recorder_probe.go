@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
+)
+
+// mediaInfo is the result of probing the final file of a recording,
+// it will be written next to the file as <recording id>.json
+type mediaInfo struct {
+	RecordingId string  `json:"recording_id"`
+	FileName    string  `json:"file_name"`
+	FileSize    int64   `json:"file_size"`
+	FormatName  string  `json:"format_name"`
+	Duration    float64 `json:"duration"`
+	Streams     int     `json:"streams"`
+	HasVideo    bool    `json:"has_video"`
+	VideoCodec  string  `json:"video_codec,omitempty"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	HasAudio    bool    `json:"has_audio"`
+	AudioCodec  string  `json:"audio_codec,omitempty"`
+	// only for mp4 & m4a, nil if the moov atom wasn't found
+	MoovAtStart *bool `json:"moov_at_start,omitempty"`
+
+	Valid    bool      `json:"valid"`
+	Problems []string  `json:"problems,omitempty"`
+	ProbedAt time.Time `json:"probed_at"`
+}
+
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		NbStreams  int    `json:"nb_streams"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+	} `json:"streams"`
+}
+
+// validateRecording probes file and checks it against what the recording must contain,
+// expectFastStart is true if post-processing has placed the moov atom at the start
+func (c *RecorderController) validateRecording(recordingId, file string, audioOnly, expectFastStart bool) *mediaInfo {
+	info := &mediaInfo{
+		RecordingId: recordingId,
+		FileName:    path.Base(file),
+		ProbedAt:    time.Now().UTC(),
+	}
+	if stat, err := os.Stat(file); err == nil {
+		info.FileSize = stat.Size()
+	}
+
+	out, err := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", file).Output()
+	if err != nil {
+		info.Problems = append(info.Problems, fmt.Sprintf("ffprobe: %s", err.Error()))
+		return info
+	}
+	probe := new(ffprobeOutput)
+	if err := json.Unmarshal(out, probe); err != nil {
+		info.Problems = append(info.Problems, fmt.Sprintf("ffprobe: %s", err.Error()))
+		return info
+	}
+
+	info.FormatName = probe.Format.FormatName
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	info.Streams = probe.Format.NbStreams
+	for _, s := range probe.Streams {
+		switch s.CodecType {
+		case "video":
+			if !info.HasVideo {
+				info.HasVideo = true
+				info.VideoCodec = s.CodecName
+				info.Width = s.Width
+				info.Height = s.Height
+			}
+		case "audio":
+			if !info.HasAudio {
+				info.HasAudio = true
+				info.AudioCodec = s.CodecName
+			}
+		}
+	}
+	if isMp4(file) {
+		if atStart, err := moovAtStart(file); err == nil {
+			info.MoovAtStart = &atStart
+		}
+	}
+
+	minDuration := float64(*c.cnf.Recorder.Validation.MinDuration)
+	if minDuration > 0 && info.Duration < minDuration {
+		info.Problems = append(info.Problems, fmt.Sprintf("duration %.1fs is less than %.0fs", info.Duration, minDuration))
+	}
+	if !info.HasAudio {
+		info.Problems = append(info.Problems, "no audio stream")
+	}
+	if !audioOnly && !info.HasVideo {
+		info.Problems = append(info.Problems, "no video stream")
+	}
+	if isMp4(file) {
+		switch {
+		case info.MoovAtStart == nil:
+			info.Problems = append(info.Problems, "no moov atom")
+		case expectFastStart && !*info.MoovAtStart:
+			info.Problems = append(info.Problems, "moov atom is after mdat")
+		}
+	}
+
+	info.Valid = len(info.Problems) == 0
+	return info
+}
+
+// isMp4 returns true if file is mp4 or m4a
+func isMp4(file string) bool {
+	ext := path.Ext(file)
+	return ext == ".mp4" || ext == ".m4a"
+}
+
+// summary is a short description for the notification
+func (m *mediaInfo) summary() string {
+	parts := []string{fmt.Sprintf("duration: %.1fs", m.Duration)}
+	if m.HasVideo {
+		parts = append(parts, fmt.Sprintf("video: %s %dx%d", m.VideoCodec, m.Width, m.Height))
+	}
+	if m.HasAudio {
+		parts = append(parts, fmt.Sprintf("audio: %s", m.AudioCodec))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// writeMediaInfo writes info next to file, returns the path of the json file
+func writeMediaInfo(file string, info *mediaInfo) (string, error) {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	jsonFile := strings.TrimSuffix(file, path.Ext(file)) + ".json"
+	return jsonFile, utils.WriteFileAtomic(jsonFile, data, 0644)
+}
+
+// moovAtStart walks the top level boxes of a mp4 file,
+// it returns true if moov comes before mdat
+func moovAtStart(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var offset int64
+	header := make([]byte, 16)
+	mdatSeen := false
+	for {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, errors.New("moov atom not found")
+			}
+			return false, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		switch size {
+		case 0:
+			// last box, extends to the end of the file
+			if boxType == "moov" {
+				return !mdatSeen, nil
+			}
+			return false, errors.New("moov atom not found")
+		case 1:
+			// 64 bit size follows the type
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return false, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if size < 8 {
+			return false, fmt.Errorf("invalid size of box %q", boxType)
+		}
+
+		switch boxType {
+		case "moov":
+			return !mdatSeen, nil
+		case "mdat":
+			mdatSeen = true
+		}
+		offset += size
+	}
+}
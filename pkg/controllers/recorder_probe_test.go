@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"encoding/binary"
+	"os"
+	"path"
+	"testing"
+)
+
+// box returns a top level mp4 box with a 32 bit size
+func box(boxType string, payload int) []byte {
+	b := make([]byte, 8+payload)
+	binary.BigEndian.PutUint32(b[:4], uint32(len(b)))
+	copy(b[4:8], boxType)
+	return b
+}
+
+// largeBox returns a box using size == 1 with the 64 bit size after the type
+func largeBox(boxType string, payload int) []byte {
+	b := make([]byte, 16+payload)
+	binary.BigEndian.PutUint32(b[:4], 1)
+	copy(b[4:8], boxType)
+	binary.BigEndian.PutUint64(b[8:16], uint64(len(b)))
+	return b
+}
+
+func join(boxes ...[]byte) []byte {
+	var data []byte
+	for _, b := range boxes {
+		data = append(data, b...)
+	}
+	return data
+}
+
+func TestMoovAtStart(t *testing.T) {
+	truncated := box("mdat", 100)[:50]
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "moov before mdat",
+			data: join(box("ftyp", 16), box("moov", 32), box("mdat", 64)),
+			want: true,
+		},
+		{
+			name: "mdat before moov",
+			data: join(box("ftyp", 16), box("mdat", 64), box("moov", 32)),
+			want: false,
+		},
+		{
+			name: "64 bit size of mdat",
+			data: join(box("ftyp", 16), largeBox("mdat", 64), box("moov", 32)),
+			want: false,
+		},
+		{
+			name: "64 bit size of free before moov",
+			data: join(box("ftyp", 16), largeBox("free", 8), box("moov", 32), box("mdat", 64)),
+			want: true,
+		},
+		{
+			name: "last moov extends to the end",
+			data: join(box("ftyp", 16), box("mdat", 64), func() []byte {
+				b := box("moov", 32)
+				binary.BigEndian.PutUint32(b[:4], 0)
+				return b
+			}()),
+			want: false,
+		},
+		{
+			name:    "truncated mdat without moov",
+			data:    join(box("ftyp", 16), truncated),
+			wantErr: true,
+		},
+		{
+			name:    "truncated header",
+			data:    join(box("ftyp", 16), []byte{0, 0, 0}),
+			wantErr: true,
+		},
+		{
+			name: "invalid box size",
+			data: join(box("ftyp", 16), func() []byte {
+				b := box("mdat", 8)
+				binary.BigEndian.PutUint32(b[:4], 4)
+				return b
+			}()),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := path.Join(t.TempDir(), "test.mp4")
+			if err := os.WriteFile(file, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := moovAtStart(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("moovAtStart() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Fatalf("moovAtStart() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
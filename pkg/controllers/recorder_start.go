@@ -1,28 +1,86 @@
 package controllers
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/retawsolit/WeMeet-recorder/pkg/journal"
+	"github.com/retawsolit/WeMeet-recorder/pkg/metrics"
 	"github.com/retawsolit/WeMeet-recorder/pkg/recorder"
-	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
 	"github.com/retawsolit/wemeet-protocol/wemeet"
-	log "github.com/sirupsen/logrus"
 )
 
-func (c *RecorderController) handleStartTask(req *wemeet.WeMeetToRecorder) error {
+func (c *RecorderController) handleStartTask(ctx context.Context, req *wemeet.WeMeetToRecorder) error {
 	id := fmt.Sprintf("%d-%d", req.RoomTableId, req.Task)
-	_, ok := c.recordersInProgress.Load(id)
-	if ok {
-		return errors.New("this request in progress")
+	tasklog.Entry(req).Infoln(fmt.Sprintf("received new start task: %s, roomTableId: %d, roomId: %s, sId: %s", req.Task.String(), req.GetRoomTableId(), req.GetRoomId(), req.GetRoomSid()))
+
+	// an output attached to a running session doesn't need a slot of its own
+	var session *recorder.Recorder
+	if c.cnf.Recorder.ShareBrowserSession {
+		session, _ = c.getSharableSession(req)
+	}
+
+	// reserve the slot before doing anything,
+	// it will be released from onAfterClose
+	if err := c.admission.reserve(id, session != nil); err != nil {
+		tasklog.Entry(req).Warnln(fmt.Sprintf("rejecting task: %s, roomTableId: %d, reason: %s", req.Task.String(), req.GetRoomTableId(), err.Error()))
+		metrics.TasksFailed.WithLabelValues(req.Task.String()).Inc()
+		return err
+	}
+	// will be ended from onAfterClose
+	ctx = c.startTaskTrace(ctx, req)
+	if session == nil {
+		// count it before starting, so that onAfterClose from any early failure
+		// will always find a counted slot to decrement
+		if err := c.countSlot(id); err != nil {
+			c.admission.release(id)
+			c.endTaskTrace(req, err)
+			metrics.TasksFailed.WithLabelValues(req.Task.String()).Inc()
+			return err
+		}
+	}
+	c.taskReceivedAt.Store(id, time.Now())
+	// will be closed from onAfterClose
+	tasklog.Open(req, recorder.OutputDir(c.cnf, req))
+	// so that we can clean up if this recorder gets killed
+	c.journalTask(req, journal.PhaseRunning, nil)
+
+	if session != nil {
+		c.recordersInProgress.Store(id, session)
+		err := session.AttachOutput(ctx, req)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, recorder.ErrSessionClosed) {
+			// the output never became part of the session
+			c.abortStartTask(req, err)
+			return err
+		}
+		// session was closing, so we'll start a new one which needs a slot
+		c.forgetRecorder(id)
+		if err = c.admission.promote(id); err == nil {
+			err = c.countSlot(id)
+		}
+		if err != nil {
+			c.abortStartTask(req, err)
+			return err
+		}
 	}
-	log.Infoln(fmt.Sprintf("received new start task: %s, roomTableId: %d, roomId: %s, sId: %s", req.Task.String(), req.GetRoomTableId(), req.GetRoomId(), req.GetRoomSid()))
 
 	rc := &recorder.Recorder{
 		AppCnf:               c.cnf,
 		Req:                  req,
+		TraceCtx:             ctx,
 		OnAfterStartCallback: c.onAfterStart,
 		OnAfterCloseCallback: c.onAfterClose,
+
+		OnDestinationStatusCallback: c.onDestinationStatus,
+		OnStateChangeCallback:       c.onStateChange,
+		OnEventCallback:             c.onEvent,
 	}
 
 	r := recorder.New(rc)
@@ -33,7 +91,7 @@ func (c *RecorderController) handleStartTask(req *wemeet.WeMeetToRecorder) error
 	var err error
 	defer func() {
 		if err != nil {
-			log.Errorln(err)
+			tasklog.Entry(req).Errorln(err)
 			r.Close(err)
 		}
 	}()
@@ -43,15 +101,70 @@ func (c *RecorderController) handleStartTask(req *wemeet.WeMeetToRecorder) error
 		return err
 	}
 
-	if err = c.ns.UpdateCurrentProgress(true); err != nil {
+	return nil
+}
+
+// countSlot adds the slot of the task id to CURRENT_PROGRESS
+func (c *RecorderController) countSlot(id string) error {
+	if err := c.ns.UpdateCurrentProgress(true); err != nil {
 		return err
 	}
-
+	c.admission.markCounted(id)
 	return nil
 }
 
-func (c *RecorderController) onAfterStart(req *wemeet.WeMeetToRecorder) {
-	log.Infoln(fmt.Sprintf("onAfterStart called for task: %s, roomTableId: %d, roomId: %s, sId: %s", req.Task.String(), req.GetRoomTableId(), req.GetRoomId(), req.GetRoomSid()))
+// abortStartTask undoes everything done for req before a recorder took it over.
+// It's safe even if onAfterClose has already run for req.
+func (c *RecorderController) abortStartTask(req *wemeet.WeMeetToRecorder, err error) {
+	id := fmt.Sprintf("%d-%d", req.RoomTableId, req.Task)
+	tasklog.Entry(req).Errorln(fmt.Sprintf("aborting task: %s, roomTableId: %d, reason: %s", req.Task.String(), req.GetRoomTableId(), err.Error()))
+
+	c.forgetRecorder(id)
+	c.taskReceivedAt.Delete(id)
+	c.endTaskTrace(req, err)
+	if counted, ok := c.admission.release(id); ok {
+		metrics.TasksFailed.WithLabelValues(req.Task.String()).Inc()
+		if counted {
+			if err := c.ns.UpdateCurrentProgress(false); err != nil {
+				tasklog.Entry(req).Errorln(err)
+			}
+		}
+	}
+	c.removeFromJournal(req)
+	tasklog.Close(req)
+}
+
+// getSharableSession returns the running session of the same room
+// doing the other kind of task, e.g. recording for rtmp
+func (c *RecorderController) getSharableSession(req *wemeet.WeMeetToRecorder) (*recorder.Recorder, bool) {
+	val, ok := c.recordersInProgress.Load(sharingTaskId(req))
+	if !ok {
+		return nil, false
+	}
+	session, ok := val.(*recorder.Recorder)
+	if ok && session.AudioOnly() && !recorder.IsAudioOnly(c.cnf, req) {
+		// no display to capture from
+		return nil, false
+	}
+	return session, ok
+}
+
+// sharingTaskId returns the id of the other kind of task of the same room,
+// which can share its session with req
+func sharingTaskId(req *wemeet.WeMeetToRecorder) string {
+	other := wemeet.RecordingTasks_START_RTMP
+	if req.Task == wemeet.RecordingTasks_START_RTMP {
+		other = wemeet.RecordingTasks_START_RECORDING
+	}
+	return fmt.Sprintf("%d-%d", req.RoomTableId, other)
+}
+
+func (c *RecorderController) onAfterStart(req *wemeet.WeMeetToRecorder, variant wemeet.CloudRecordingVariants) {
+	tasklog.Entry(req).Infoln(fmt.Sprintf("onAfterStart called for task: %s, roomTableId: %d, roomId: %s, sId: %s", req.Task.String(), req.GetRoomTableId(), req.GetRoomId(), req.GetRoomSid()))
+	metrics.TasksStarted.WithLabelValues(req.Task.String()).Inc()
+	if receivedAt, ok := c.taskReceivedAt.LoadAndDelete(fmt.Sprintf("%d-%d", req.RoomTableId, req.Task)); ok {
+		metrics.JoinLatency.WithLabelValues(req.Task.String()).Observe(time.Since(receivedAt.(time.Time)).Seconds())
+	}
 
 	// notify to wemeet
 	toSend := &wemeet.RecorderToWeMeet{
@@ -62,11 +175,49 @@ func (c *RecorderController) onAfterStart(req *wemeet.WeMeetToRecorder) {
 		RecordingId: req.RecordingId,
 		RecorderId:  req.RecorderId,
 		RoomTableId: req.RoomTableId,
+
+		RecordingVariant: recordingVariant(req, variant),
 	}
-	log.Infoln(fmt.Sprintf("notifyToWeMeet with data: %+v", toSend))
+	c.notify(c.taskTraceCtx(req), req, toSend)
+}
 
-	_, err := utils.NotifyToWeMeet(c.cnf.WeMeetInfo.Host, c.cnf.WeMeetInfo.ApiKey, c.cnf.WeMeetInfo.ApiSecret, toSend, nil)
-	if err != nil {
-		log.Errorln(err)
+// recordingVariant will be sent only for recording, it has no meaning for rtmp
+func recordingVariant(req *wemeet.WeMeetToRecorder, variant wemeet.CloudRecordingVariants) *wemeet.CloudRecordingVariants {
+	if req.Task != wemeet.RecordingTasks_START_RECORDING {
+		return nil
+	}
+	return &variant
+}
+
+// onDestinationStatus will inform wemeet about the state of every destination during rtmp fan-out.
+// Status is about the task, which keeps running even if all of its destinations have failed,
+// so it's always true and the states are only in the message.
+func (c *RecorderController) onDestinationStatus(req *wemeet.WeMeetToRecorder, statuses []recorder.DestinationStatus) {
+	var running int
+	var parts []string
+	for _, s := range statuses {
+		state := "running"
+		switch {
+		case s.Running:
+			running++
+		case s.Failed:
+			state = fmt.Sprintf("failed after error: %s", s.LastError)
+		case s.LastError != "":
+			state = fmt.Sprintf("retrying after error: %s", s.LastError)
+		default:
+			state = "retrying"
+		}
+		parts = append(parts, fmt.Sprintf("%s: %s, retries: %d", s.Destination, state, s.Retries))
+	}
+
+	toSend := &wemeet.RecorderToWeMeet{
+		From:        "recorder",
+		Status:      true,
+		Task:        req.Task,
+		Msg:         fmt.Sprintf("destinations status: %d/%d running; %s", running, len(statuses), strings.Join(parts, "; ")),
+		RecordingId: req.RecordingId,
+		RecorderId:  req.RecorderId,
+		RoomTableId: req.RoomTableId,
 	}
+	c.notify(c.taskTraceCtx(req), req, toSend)
 }
@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/metrics"
+	"github.com/retawsolit/WeMeet-recorder/pkg/recorder"
+	natsservice "github.com/retawsolit/WeMeet-recorder/pkg/services/nats"
+	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
+	"github.com/retawsolit/WeMeet-recorder/version"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	log "github.com/sirupsen/logrus"
+)
+
+// recorderStatus keeps the part of the status which won't change while running
+type recorderStatus struct {
+	bootedAt      time.Time
+	chromeVersion string
+	ffmpegVersion string
+	// task ids stored in the bucket, only used by the ping goroutine
+	published map[string]bool
+
+	sync.Mutex
+}
+
+func newRecorderStatus() *recorderStatus {
+	return &recorderStatus{
+		bootedAt:  time.Now().UTC(),
+		published: make(map[string]bool),
+	}
+}
+
+// detectVersions may take a while, so it shouldn't delay the ping
+func (s *recorderStatus) detectVersions(customChromePath *string) {
+	chrome := utils.GetChromeVersion(customChromePath)
+	ffmpeg := utils.GetFfmpegVersion()
+
+	s.Lock()
+	defer s.Unlock()
+	s.chromeVersion = chrome
+	s.ffmpegVersion = ffmpeg
+}
+
+// initStatus will remove the tasks left in the bucket by the previous run
+func (c *RecorderController) initStatus() {
+	go c.status.detectVersions(c.cnf.Recorder.CustomChromePath)
+
+	ids, err := c.ns.TaskStatusIds()
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+	for _, id := range ids {
+		// will be removed in next update if not active
+		c.status.published[id] = true
+	}
+}
+
+// updateStatus will write the status of this recorder & its active tasks
+// in the bucket and remove the tasks which have ended
+func (c *RecorderController) updateStatus() {
+	now := time.Now().UTC()
+
+	active := make(map[string]bool)
+	for _, ts := range c.activeTasks(now) {
+		active[ts.Id] = true
+		if err := c.ns.UpdateTaskStatus(ts); err != nil {
+			log.Errorln(err)
+			continue
+		}
+		c.status.published[ts.Id] = true
+	}
+
+	for id := range c.status.published {
+		if active[id] {
+			continue
+		}
+		if err := c.ns.DeleteTaskStatus(id); err != nil {
+			log.Errorln(err)
+			continue
+		}
+		delete(c.status.published, id)
+	}
+
+	rs := &natsservice.RecorderStatus{
+		RecorderId:  c.cnf.Recorder.Id,
+		Version:     version.Version,
+		Runtime:     runtime.Version(),
+		MaxLimit:    c.cnf.Recorder.MaxLimit,
+		ActiveTasks: c.admission.active(),
+		Draining:    c.admission.isDraining(),
+		BootedAt:    c.status.bootedAt,
+		UpdatedAt:   now,
+	}
+	if rs.Draining {
+		rs.MaxLimit = 0
+	}
+	metrics.ActiveSessions.Set(float64(rs.ActiveTasks))
+	metrics.MaxLimit.Set(float64(rs.MaxLimit))
+	if c.outbox != nil {
+		metrics.NotifyPending.Set(float64(c.outbox.Pending()))
+	}
+	c.status.Lock()
+	rs.ChromeVersion = c.status.chromeVersion
+	rs.FfmpegVersion = c.status.ffmpegVersion
+	c.status.Unlock()
+
+	host, err := utils.GetHostResources(c.cnf.Recorder.CopyToPath.MainPath)
+	if err != nil {
+		log.Errorln(fmt.Sprintf("unable to read host resources: %s", err.Error()))
+	}
+	rs.Host = host
+
+	if err := c.ns.UpdateRecorderStatus(rs); err != nil {
+		log.Errorln(err)
+	}
+}
+
+// ActiveTasks returns the status of all the tasks in progress
+func (c *RecorderController) ActiveTasks() []*natsservice.TaskStatus {
+	return c.activeTasks(time.Now().UTC())
+}
+
+// CheckCapacity returns an error if new tasks won't be accepted
+func (c *RecorderController) CheckCapacity() error {
+	if c.admission.isDraining() {
+		return errDraining
+	}
+	if sessions := c.admission.sessions(); uint64(sessions) >= c.cnf.Recorder.MaxLimit {
+		return fmt.Errorf("recorder is at max limit of %d tasks", c.cnf.Recorder.MaxLimit)
+	}
+	return nil
+}
+
+// activeTasks returns the status of all the tasks in progress
+func (c *RecorderController) activeTasks(now time.Time) []*natsservice.TaskStatus {
+	var tasks []*natsservice.TaskStatus
+	c.recordersInProgress.Range(func(key, value interface{}) bool {
+		id, _ := key.(string)
+		r, ok := value.(*recorder.Recorder)
+		if !ok {
+			return true
+		}
+		task, ok := taskOfId(id)
+		if !ok {
+			return true
+		}
+		info, ok := r.OutputInfo(task)
+		if !ok {
+			return true
+		}
+
+		ts := &natsservice.TaskStatus{
+			Id:             id,
+			RoomId:         info.Req.GetRoomId(),
+			RoomTableId:    info.Req.GetRoomTableId(),
+			RecordingId:    info.Req.GetRecordingId(),
+			Task:           info.Req.Task.String(),
+			OutputBytes:    info.Bytes,
+			FfmpegRestarts: info.FfmpegRestarts,
+			AudioOnly:      info.AudioOnly,
+			Progress:       info.Progress,
+			UpdatedAt:      now,
+		}
+		if !info.StartedAt.IsZero() {
+			ts.StartedAt = &info.StartedAt
+		}
+		tasks = append(tasks, ts)
+		return true
+	})
+	return tasks
+}
+
+// taskOfId returns the task from the id of recordersInProgress
+func taskOfId(id string) (wemeet.RecordingTasks, bool) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 {
+		return 0, false
+	}
+	task, err := strconv.ParseInt(id[i+1:], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return wemeet.RecordingTasks(task), true
+}
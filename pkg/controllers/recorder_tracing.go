@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/tracing"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// taskTrace is the span of a task from the start until it was closed
+type taskTrace struct {
+	ctx  context.Context
+	span trace.Span
+}
+
+// startTaskTrace returns the context for the spans of the task
+func (c *RecorderController) startTaskTrace(ctx context.Context, req *wemeet.WeMeetToRecorder) context.Context {
+	ctx, span := tracing.Start(ctx, fmt.Sprintf("task %s", req.Task.String()), tracing.TaskAttributes(req)...)
+	c.taskTraces.Store(fmt.Sprintf("%d-%d", req.RoomTableId, req.Task), &taskTrace{ctx: ctx, span: span})
+	return ctx
+}
+
+// taskTraceCtx returns the context of the running task, or an empty one
+func (c *RecorderController) taskTraceCtx(req *wemeet.WeMeetToRecorder) context.Context {
+	if val, ok := c.taskTraces.Load(fmt.Sprintf("%d-%d", req.RoomTableId, req.Task)); ok {
+		return val.(*taskTrace).ctx
+	}
+	return context.Background()
+}
+
+// endTaskTrace ends the span of the task, returned context can still be used
+// for the spans of the work after the end, e.g. post-processing
+func (c *RecorderController) endTaskTrace(req *wemeet.WeMeetToRecorder, err error) context.Context {
+	val, ok := c.taskTraces.LoadAndDelete(fmt.Sprintf("%d-%d", req.RoomTableId, req.Task))
+	if !ok {
+		return context.Background()
+	}
+	t := val.(*taskTrace)
+	tracing.End(t.span, err)
+	return t.ctx
+}
@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"buf.build/go/protovalidate"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+// same as the characters allowed for the recorder id, so these are safe
+// for nats subjects & file paths
+var safeIdRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// taskViolation is a single rule failed by the task
+type taskViolation struct {
+	Field string
+	Rule  string
+	Msg   string
+}
+
+// taskValidationError will be sent back as the message of the rejection,
+// e.g. invalid task: recording_id: value is required [required]; rtmp_url: ...
+type taskValidationError struct {
+	Violations []taskViolation
+}
+
+func (e *taskValidationError) Error() string {
+	var parts []string
+	for _, v := range e.Violations {
+		parts = append(parts, fmt.Sprintf("%s: %s [%s]", v.Field, v.Msg, v.Rule))
+	}
+	return "invalid task: " + strings.Join(parts, "; ")
+}
+
+func (e *taskValidationError) add(field, rule, format string, a ...any) {
+	e.Violations = append(e.Violations, taskViolation{
+		Field: field,
+		Rule:  rule,
+		Msg:   fmt.Sprintf(format, a...),
+	})
+}
+
+// validateTask checks the rules of protocol and our own rules for the task,
+// so that we never start anything with incomplete information
+func (c *RecorderController) validateTask(req *wemeet.WeMeetToRecorder) error {
+	verr := new(taskValidationError)
+
+	if err := protovalidate.Validate(req); err != nil {
+		var pErr *protovalidate.ValidationError
+		if !errors.As(err, &pErr) {
+			return err
+		}
+		for _, v := range pErr.Violations {
+			verr.add(protovalidate.FieldPathString(v.Proto.GetField()), v.Proto.GetRuleId(), "%s", v.Proto.GetMessage())
+		}
+	}
+
+	if _, ok := wemeet.RecordingTasks_name[int32(req.Task)]; !ok {
+		verr.add("task", "enum.defined_only", "unknown task %d", req.Task)
+	}
+	if req.GetRoomTableId() <= 0 {
+		verr.add("room_table_id", "gt", "value must be greater than 0")
+	}
+
+	switch req.Task {
+	case wemeet.RecordingTasks_START_RECORDING, wemeet.RecordingTasks_START_RTMP:
+		for field, value := range map[string]string{
+			"room_id":      req.GetRoomId(),
+			"recording_id": req.GetRecordingId(),
+			"recorder_id":  req.GetRecorderId(),
+		} {
+			if value == "" {
+				verr.add(field, "required", "value is required")
+			} else if !safeIdRegex.MatchString(value) {
+				verr.add(field, "pattern", "value must contain only a-z, A-Z, 0-9, - and _")
+			}
+		}
+		if req.GetAccessToken() == "" {
+			verr.add("access_token", "required", "value is required")
+		}
+		if req.Task == wemeet.RecordingTasks_START_RTMP {
+			c.validateLiveUrls(req, verr)
+		}
+	}
+
+	if len(verr.Violations) > 0 {
+		// keep the order stable for the response
+		slices.SortStableFunc(verr.Violations, func(a, b taskViolation) int {
+			return strings.Compare(a.Field, b.Field)
+		})
+		return verr
+	}
+	return nil
+}
+
+// validateLiveUrls checks every url of rtmp_url. Local files can't be requested,
+// those can be set only from room_overrides.
+func (c *RecorderController) validateLiveUrls(req *wemeet.WeMeetToRecorder, verr *taskValidationError) {
+	var urls []string
+	for _, raw := range strings.Split(req.GetRtmpUrl(), ",") {
+		if raw = strings.TrimSpace(raw); raw != "" {
+			urls = append(urls, raw)
+		}
+	}
+	if len(urls) == 0 {
+		verr.add("rtmp_url", "required", "value is required")
+		return
+	}
+
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			verr.add("rtmp_url", "uri", "invalid url")
+			continue
+		}
+
+		switch strings.ToLower(u.Scheme) {
+		case "hls":
+			// served by hls_server, path is decided by us
+			continue
+		case "rtmp", "rtmps", "srt":
+		default:
+			verr.add("rtmp_url", "scheme", "scheme %q is not allowed", u.Scheme)
+			continue
+		}
+
+		if u.Hostname() == "" {
+			verr.add("rtmp_url", "host", "host is required")
+			continue
+		}
+		allowed := c.cnf.Recorder.AllowedLiveHosts
+		if len(allowed) > 0 && !slices.Contains(allowed, strings.ToLower(u.Hostname())) {
+			verr.add("rtmp_url", "host", "host %q is not allowed", u.Hostname())
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+func validTask(task wemeet.RecordingTasks) *wemeet.WeMeetToRecorder {
+	req := &wemeet.WeMeetToRecorder{
+		From:        "wemeet",
+		Task:        task,
+		RoomTableId: 1,
+		RoomId:      "room-1",
+		RoomSid:     "RM_1",
+		RecordingId: "REC_1",
+		RecorderId:  "node_01",
+		AccessToken: "token",
+	}
+	if task == wemeet.RecordingTasks_START_RTMP {
+		rtmpUrl := "rtmp://a.rtmp.youtube.com/live2/key"
+		req.RtmpUrl = &rtmpUrl
+	}
+	return req
+}
+
+func withRtmpUrl(u string) func(req *wemeet.WeMeetToRecorder) {
+	return func(req *wemeet.WeMeetToRecorder) {
+		req.RtmpUrl = &u
+	}
+}
+
+func TestValidateTask(t *testing.T) {
+	tests := []struct {
+		name         string
+		task         wemeet.RecordingTasks
+		allowedHosts []string
+		change       func(req *wemeet.WeMeetToRecorder)
+		// field & rule of the expected violation, empty if the task is valid
+		field, rule string
+	}{
+		{name: "valid recording", task: wemeet.RecordingTasks_START_RECORDING},
+		{name: "valid rtmp", task: wemeet.RecordingTasks_START_RTMP},
+		{
+			name:   "rtmp without rtmp_url",
+			task:   wemeet.RecordingTasks_START_RTMP,
+			change: func(req *wemeet.WeMeetToRecorder) { req.RtmpUrl = nil },
+			field:  "rtmp_url", rule: "required",
+		},
+		{
+			name:   "rtmp with blank rtmp_url",
+			task:   wemeet.RecordingTasks_START_RTMP,
+			change: withRtmpUrl(" , "),
+			field:  "rtmp_url", rule: "required",
+		},
+		{
+			name:   "empty recording_id",
+			task:   wemeet.RecordingTasks_START_RECORDING,
+			change: func(req *wemeet.WeMeetToRecorder) { req.RecordingId = "" },
+			field:  "recording_id", rule: "required",
+		},
+		{
+			name:   "empty room_id",
+			task:   wemeet.RecordingTasks_START_RTMP,
+			change: func(req *wemeet.WeMeetToRecorder) { req.RoomId = "" },
+			field:  "room_id", rule: "required",
+		},
+		{
+			name:   "empty access_token",
+			task:   wemeet.RecordingTasks_START_RECORDING,
+			change: func(req *wemeet.WeMeetToRecorder) { req.AccessToken = "" },
+			field:  "access_token", rule: "required",
+		},
+		{
+			name:   "recording_id with path",
+			task:   wemeet.RecordingTasks_START_RECORDING,
+			change: func(req *wemeet.WeMeetToRecorder) { req.RecordingId = "../../etc" },
+			field:  "recording_id", rule: "pattern",
+		},
+		{
+			name:   "room_id with nats wildcard",
+			task:   wemeet.RecordingTasks_START_RECORDING,
+			change: func(req *wemeet.WeMeetToRecorder) { req.RoomId = "room.*" },
+			field:  "room_id", rule: "pattern",
+		},
+		{
+			name:   "recorder_id with space",
+			task:   wemeet.RecordingTasks_START_RTMP,
+			change: func(req *wemeet.WeMeetToRecorder) { req.RecorderId = "node 01" },
+			field:  "recorder_id", rule: "pattern",
+		},
+		{
+			name:   "room_table_id not set",
+			task:   wemeet.RecordingTasks_STOP_RECORDING,
+			change: func(req *wemeet.WeMeetToRecorder) { req.RoomTableId = 0 },
+			field:  "room_table_id", rule: "gt",
+		},
+		{
+			name:  "unknown task",
+			task:  wemeet.RecordingTasks(1000),
+			field: "task", rule: "enum.defined_only",
+		},
+		{
+			name:   "http scheme",
+			task:   wemeet.RecordingTasks_START_RTMP,
+			change: withRtmpUrl("http://example.com/live"),
+			field:  "rtmp_url", rule: "scheme",
+		},
+		{
+			name:   "file scheme",
+			task:   wemeet.RecordingTasks_START_RTMP,
+			change: withRtmpUrl("file:///etc/passwd"),
+			field:  "rtmp_url", rule: "scheme",
+		},
+		{
+			name:   "local file+hls can't be requested",
+			task:   wemeet.RecordingTasks_START_RTMP,
+			change: withRtmpUrl("file+hls:///var/www/hls/room"),
+			field:  "rtmp_url", rule: "scheme",
+		},
+		{
+			name:   "one of many urls has a bad scheme",
+			task:   wemeet.RecordingTasks_START_RTMP,
+			change: withRtmpUrl("rtmp://a.rtmp.youtube.com/live2/key, udp://10.0.0.1:1234"),
+			field:  "rtmp_url", rule: "scheme",
+		},
+		{
+			name:   "rtmp without host",
+			task:   wemeet.RecordingTasks_START_RTMP,
+			change: withRtmpUrl("rtmp:///live/key"),
+			field:  "rtmp_url", rule: "host",
+		},
+		{
+			name:   "srt, rtmps & local hls are allowed",
+			task:   wemeet.RecordingTasks_START_RTMP,
+			change: withRtmpUrl("srt://live.example.com:9000?streamid=key,rtmps://live.example.com/app/key,hls://local"),
+		},
+		{
+			name:         "host in allowed_live_hosts",
+			task:         wemeet.RecordingTasks_START_RTMP,
+			allowedHosts: []string{"live.example.com", "a.rtmp.youtube.com"},
+			change:       withRtmpUrl("rtmp://A.RTMP.YouTube.com/live2/key"),
+		},
+		{
+			name:         "host not in allowed_live_hosts",
+			task:         wemeet.RecordingTasks_START_RTMP,
+			allowedHosts: []string{"live.example.com"},
+			field:        "rtmp_url", rule: "host",
+		},
+		{
+			name:         "allowed_live_hosts doesn't apply to local hls",
+			task:         wemeet.RecordingTasks_START_RTMP,
+			allowedHosts: []string{"live.example.com"},
+			change:       withRtmpUrl("hls://local"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cnf := new(config.AppConfig)
+			cnf.Recorder.AllowedLiveHosts = tt.allowedHosts
+			c := &RecorderController{cnf: cnf}
+			req := validTask(tt.task)
+			if tt.change != nil {
+				tt.change(req)
+			}
+
+			err := c.validateTask(req)
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("valid task was rejected: %v", err)
+				}
+				return
+			}
+
+			var verr *taskValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected a validation error, got: %v", err)
+			}
+			for _, v := range verr.Violations {
+				if v.Field == tt.field && v.Rule == tt.rule {
+					return
+				}
+			}
+			t.Fatalf("expected violation %s [%s], got: %v", tt.field, tt.rule, err)
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package journal
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
+)
+
+const (
+	// PhaseRunning the task is running, nothing was sent to the server about its end
+	PhaseRunning = "running"
+	// PhasePostProcessing the task was ended, but the recording wasn't processed yet
+	PhasePostProcessing = "post_processing"
+)
+
+// Process is a child process of a task, used to find the leftovers after a crash
+type Process struct {
+	Name string `json:"name"`
+	Pid  int    `json:"pid"`
+	// must be found in the cmdline of the pid, so that we never kill a reused pid
+	Match string `json:"match,omitempty"`
+}
+
+// Entry is the persisted state of a single task
+type Entry struct {
+	Id    string `json:"id"`
+	Phase string `json:"phase"`
+	// WeMeetToRecorder in protojson
+	Request json.RawMessage `json:"request"`
+
+	FilePath      string    `json:"file_path,omitempty"`
+	FileNames     []string  `json:"file_names,omitempty"`
+	AudioOnly     bool      `json:"audio_only,omitempty"`
+	Variant       int32     `json:"variant"`
+	Processes     []Process `json:"processes,omitempty"`
+	PulseSinkId   string    `json:"pulse_sink_id,omitempty"`
+	PulseSinkName string    `json:"pulse_sink_name,omitempty"`
+
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Journal keeps one json file per active task in dir,
+// every write is atomic, so a crash will never leave a partial file
+type Journal struct {
+	dir string
+	sync.Mutex
+}
+
+func Open(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Journal{dir: dir}, nil
+}
+
+func (j *Journal) Put(e *Entry) error {
+	j.Lock()
+	defer j.Unlock()
+
+	e.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(j.fileName(e.Id), data, 0644)
+}
+
+// Get returns nil if there is no entry for id
+func (j *Journal) Get(id string) (*Entry, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	data, err := os.ReadFile(j.fileName(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	e := new(Entry)
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (j *Journal) Remove(id string) error {
+	j.Lock()
+	defer j.Unlock()
+
+	err := os.Remove(j.fileName(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns all the entries, unreadable files will be returned as errs
+func (j *Journal) List() ([]*Entry, []error) {
+	j.Lock()
+	defer j.Unlock()
+
+	files, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var entries []*Entry
+	var errs []error
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(path.Join(j.dir, f.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		e := new(Entry)
+		if err := json.Unmarshal(data, e); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, errs
+}
+
+func (j *Journal) fileName(id string) string {
+	return path.Join(j.dir, id+".json")
+}
@@ -0,0 +1,134 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+func TestPutGetRemove(t *testing.T) {
+	j, err := Open(path.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, err := j.Get("rec1-1"); err != nil || e != nil {
+		t.Fatalf("unknown id must return nil, got: %v, %v", e, err)
+	}
+
+	e := &Entry{
+		Id:        "rec1-1",
+		Phase:     PhaseRunning,
+		Request:   json.RawMessage(`{"task":"START_RECORDING","recordingId":"rec1"}`),
+		FilePath:  "/recordings/room1",
+		FileNames: []string{"rec1_raw.mp4"},
+		Processes: []Process{{Name: "ffmpeg", Pid: 100, Match: "rec1"}},
+	}
+	if err := j.Put(e); err != nil {
+		t.Fatal(err)
+	}
+	if e.UpdatedAt.IsZero() {
+		t.Fatal("updated_at wasn't set")
+	}
+
+	got, err := j.Get("rec1-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := new(bytes.Buffer)
+	if err := json.Compact(request, got.Request); err != nil {
+		t.Fatal(err)
+	}
+	if got.Phase != PhaseRunning || got.FilePath != e.FilePath || len(got.FileNames) != 1 ||
+		len(got.Processes) != 1 || got.Processes[0] != e.Processes[0] || request.String() != string(e.Request) {
+		t.Fatalf("unexpected entry: %+v", got)
+	}
+
+	// update replaces the entry
+	e.Phase = PhasePostProcessing
+	e.FileNames = append(e.FileNames, "rec1_raw_part1.mp4")
+	if err := j.Put(e); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = j.Get("rec1-1")
+	if got.Phase != PhasePostProcessing || len(got.FileNames) != 2 {
+		t.Fatalf("entry wasn't updated: %+v", got)
+	}
+
+	if err := j.Remove("rec1-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := j.Get("rec1-1"); got != nil {
+		t.Fatal("entry wasn't removed")
+	}
+	// removing twice is fine
+	if err := j.Remove("rec1-1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListAfterReopen(t *testing.T) {
+	dir := path.Join(t.TempDir(), "journal")
+	j, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"rec1-1", "rec2-2"} {
+		if err := j.Put(&Entry{Id: id, Phase: PhaseRunning}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a partial file of a crash & files which aren't entries
+	if err := os.WriteFile(path.Join(dir, "broken.json"), []byte(`{"id": "bro`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "rec3-1.json.tmp"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(dir, "sub.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// as after a restart
+	j, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, errs := j.List()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error for the broken file, got: %v", errs)
+	}
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.Id)
+	}
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "rec1-1" || ids[1] != "rec2-2" {
+		t.Fatalf("unexpected entries: %v", ids)
+	}
+}
+
+func TestKillIfRunningIgnoresOtherProcesses(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Process
+	}{
+		{name: "no pid", p: Process{Name: "ffmpeg"}},
+		{name: "pid not running", p: Process{Name: "ffmpeg", Pid: 1 << 30}},
+		// this test binary isn't ffmpeg
+		{name: "pid reused by another program", p: Process{Name: "ffmpeg", Pid: os.Getpid()}},
+		{name: "cmdline doesn't match", p: Process{Name: path.Base(os.Args[0]), Pid: os.Getpid(), Match: "not-in-the-cmdline"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			killed, err := tt.p.KillIfRunning()
+			if err != nil || killed {
+				t.Fatalf("got killed: %t, error: %v", killed, err)
+			}
+		})
+	}
+}
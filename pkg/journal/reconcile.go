@@ -0,0 +1,72 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// KillIfRunning will kill the process if the pid is still running the same program.
+// It returns true if the process was killed.
+func (p Process) KillIfRunning() (bool, error) {
+	if p.Pid <= 0 {
+		return false, nil
+	}
+
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", p.Pid))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	args := bytes.Split(bytes.TrimRight(cmdline, "\x00"), []byte{0})
+	if len(args) == 0 || !strings.Contains(strings.ToLower(path.Base(string(args[0]))), strings.ToLower(p.Name)) {
+		// pid was reused by something else
+		return false, nil
+	}
+	if p.Match != "" && !bytes.Contains(cmdline, []byte(p.Match)) {
+		return false, nil
+	}
+
+	if err := syscall.Kill(p.Pid, syscall.SIGKILL); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UnloadPulseSink will unload the module only if it's still the null sink of sinkName
+func UnloadPulseSink(moduleId, sinkName string) (bool, error) {
+	if moduleId == "" {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "pactl", "list", "short", "modules").Output()
+	if err != nil {
+		return false, err
+	}
+
+	for _, l := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) < 3 || fields[0] != moduleId {
+			continue
+		}
+		if fields[1] != "module-null-sink" || !strings.Contains(l, sinkName) {
+			return false, nil
+		}
+		if out, err := exec.CommandContext(ctx, "pactl", "unload-module", moduleId).CombinedOutput(); err != nil {
+			return false, fmt.Errorf("%s, %s", err.Error(), strings.TrimSpace(string(out)))
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
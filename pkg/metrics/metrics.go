@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "wemeet_recorder"
+
+var (
+	// TasksStarted counts the tasks which were started successfully, by task
+	TasksStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_started_total",
+		Help:      "Tasks started successfully, by task.",
+	}, []string{"task"})
+
+	// TasksFailed counts the tasks which were rejected or ended with an error, by task
+	TasksFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_failed_total",
+		Help:      "Tasks rejected or ended with an error, by task.",
+	}, []string{"task"})
+
+	// TasksStopped counts the tasks which ended without any error, by task
+	TasksStopped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_stopped_total",
+		Help:      "Tasks ended without any error, by task.",
+	}, []string{"task"})
+
+	// JoinLatency is the time from receiving a start task until the output was started
+	JoinLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "join_latency_seconds",
+		Help:      "Time from receiving a start task until the output was started.",
+		Buckets:   []float64{1, 2, 5, 10, 15, 20, 30, 45, 60, 90, 120},
+	}, []string{"task"})
+
+	// RecordingDuration is the time from the start of the output until it was closed
+	RecordingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "recording_duration_seconds",
+		Help:      "Time from the start of the output until it was closed.",
+		Buckets:   []float64{60, 300, 900, 1800, 3600, 2 * 3600, 4 * 3600, 8 * 3600},
+	}, []string{"task"})
+
+	// ProcessExits counts the unexpected exits of the child processes
+	ProcessExits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "process_unexpected_exits_total",
+		Help:      "Unexpected exits of ffmpeg, Xvfb and chrome, by exit code.",
+	}, []string{"process", "exit_code"})
+
+	// FfmpegFps is the latest fps reported by ffmpeg, by task id
+	FfmpegFps = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ffmpeg_fps",
+		Help:      "Latest frames per second reported by ffmpeg, by task id.",
+	}, []string{"id"})
+
+	// FfmpegSpeed is the latest encoding speed reported by ffmpeg, by task id
+	FfmpegSpeed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ffmpeg_speed",
+		Help:      "Latest encoding speed reported by ffmpeg, 1 is realtime, by task id.",
+	}, []string{"id"})
+
+	// FfmpegBitrate is the latest bitrate reported by ffmpeg, by task id
+	FfmpegBitrate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ffmpeg_bitrate_kbps",
+		Help:      "Latest bitrate in kbit/s reported by ffmpeg, by task id.",
+	}, []string{"id"})
+
+	// FfmpegDroppedFrames is the number of dropped frames of the current ffmpeg process, by task id
+	FfmpegDroppedFrames = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ffmpeg_dropped_frames",
+		Help:      "Dropped frames of the current ffmpeg process, by task id.",
+	}, []string{"id"})
+
+	// FfmpegDuplicatedFrames is the number of duplicated frames of the current ffmpeg process, by task id
+	FfmpegDuplicatedFrames = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ffmpeg_duplicated_frames",
+		Help:      "Duplicated frames of the current ffmpeg process, by task id.",
+	}, []string{"id"})
+
+	// FfmpegStalls counts the times the output time of ffmpeg stopped advancing, by task
+	FfmpegStalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ffmpeg_stalls_total",
+		Help:      "Times the output time of ffmpeg stopped advancing, by task.",
+	}, []string{"task"})
+
+	// PostProcessingDuration is the time to process a recording after it has ended
+	PostProcessingDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "post_processing_duration_seconds",
+		Help:      "Time to process a recording after it has ended.",
+		Buckets:   []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800},
+	})
+
+	// PostProcessingFailures counts the failures of post-processing, by stage
+	PostProcessingFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "post_processing_failures_total",
+		Help:      "Failures of post-processing, by stage.",
+	}, []string{"stage"})
+
+	// NotifyAttempts counts the attempts to deliver a notification to the server, by status code
+	NotifyAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notify_attempts_total",
+		Help:      "Attempts to deliver a notification to the server, by status code (0 if no response).",
+	}, []string{"status_code"})
+
+	// NotifyFailures counts the failed attempts to deliver a notification to the server, by status code
+	NotifyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notify_failures_total",
+		Help:      "Failed attempts to deliver a notification to the server, by status code (0 if no response).",
+	}, []string{"status_code"})
+
+	// NotifyPending is the number of notifications waiting in the outbox
+	NotifyPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "notify_pending",
+		Help:      "Notifications waiting in the outbox.",
+	})
+
+	// KvUpdateRetries counts the conflicts while updating the current progress in the kv bucket
+	KvUpdateRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kv_update_retries_total",
+		Help:      "Retries because of conflicts while updating the current progress in the kv bucket.",
+	})
+
+	// TaskAuthRejected counts the tasks which failed the signature check
+	TaskAuthRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "task_auth_rejected_total",
+		Help:      "Tasks which failed the signature check.",
+	})
+
+	// ActiveSessions is the number of reserved slots
+	ActiveSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_sessions",
+		Help:      "Tasks in progress on this recorder.",
+	})
+
+	// MaxLimit is the advertised capacity, 0 while draining
+	MaxLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "max_limit",
+		Help:      "Maximum number of tasks accepted by this recorder, 0 while draining.",
+	})
+)
@@ -0,0 +1,342 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// messages are kept in these dirs of the outbox
+const (
+	Pending   = "pending"
+	Delivered = "delivered"
+	// rejected by the server as invalid, retrying won't help
+	Failed = "failed"
+)
+
+// Sender delivers a single notification and returns the http status code,
+// it should give up once ctx is done
+type Sender func(ctx context.Context, req *wemeet.RecorderToWeMeet) (int, error)
+
+// Message is a notification stored in the outbox
+type Message struct {
+	Id  string `json:"id"`
+	Key string `json:"key"`
+	// RecorderToWeMeet in protojson
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+	FailedAt      *time.Time      `json:"failed_at,omitempty"`
+	StatusCode    int             `json:"status_code,omitempty"`
+}
+
+// Outbox is a file based queue of notifications for WeMeet server.
+// Messages with the same key (e.g. recording id) are delivered in order,
+// a failing message will be retried forever with capped backoff
+// without blocking the messages of other keys. Only a 2xx response is
+// a delivery, messages rejected as invalid (400, 413, 422) are moved to failed.
+type Outbox struct {
+	dir           string
+	send          Sender
+	maxBackoff    time.Duration
+	keepDelivered time.Duration
+
+	wake chan struct{}
+	seq  atomic.Uint64
+	// ignore the backoff while flushing
+	flushing atomic.Bool
+	// keys having a running worker
+	busy map[string]bool
+	sync.Mutex
+	workers sync.WaitGroup
+}
+
+func New(dir string, send Sender, maxBackoff, keepDelivered time.Duration) (*Outbox, error) {
+	for _, d := range []string{Pending, Delivered, Failed} {
+		if err := os.MkdirAll(path.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Outbox{
+		dir:           dir,
+		send:          send,
+		maxBackoff:    maxBackoff,
+		keepDelivered: keepDelivered,
+		wake:          make(chan struct{}, 1),
+		busy:          make(map[string]bool),
+	}, nil
+}
+
+// Enqueue will persist the notification, it will be delivered by Run
+func (o *Outbox) Enqueue(key string, req *wemeet.RecorderToWeMeet) error {
+	payload, err := protojson.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	m := &Message{
+		// lexical order is the order of creation
+		Id:            fmt.Sprintf("%019d-%06d", now.UnixNano(), o.seq.Add(1)%1000000),
+		Key:           key,
+		Payload:       payload,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+	if err := writeMessage(path.Join(o.dir, Pending), m); err != nil {
+		return err
+	}
+
+	o.notify()
+	return nil
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the pending messages until ctx is done,
+// it returns once all the running deliveries have stopped
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer o.workers.Wait()
+	lastPrune := time.Time{}
+
+	for {
+		o.startWorkers(ctx)
+		if time.Since(lastPrune) > time.Hour {
+			o.pruneDelivered()
+			lastPrune = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// Pending returns the number of messages waiting for delivery
+func (o *Outbox) Pending() int {
+	msgs, _ := List(o.dir, Pending)
+	return len(msgs)
+}
+
+// Flush retries the pending messages without waiting for their backoff
+// and returns once all of them were delivered or ctx is done.
+// Run must be running to deliver them.
+func (o *Outbox) Flush(ctx context.Context) error {
+	o.flushing.Store(true)
+	defer o.flushing.Store(false)
+
+	// failed ones will be retried by every pass of Run
+	o.notify()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for o.Pending() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("outbox: %d notifications are still pending: %w", o.Pending(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// startWorkers starts a worker for every key having pending messages,
+// so that a slow delivery can only delay the messages of its own key
+func (o *Outbox) startWorkers(ctx context.Context) {
+	// a worker can't finish between listing and starting, otherwise its delivered messages could be picked again
+	o.Lock()
+	defer o.Unlock()
+
+	msgs, err := List(o.dir, Pending)
+	if err != nil {
+		log.Errorln("outbox:", err)
+		return
+	}
+
+	byKey := make(map[string][]*Message)
+	for _, m := range msgs {
+		byKey[m.Key] = append(byKey[m.Key], m)
+	}
+
+	for k, queue := range byKey {
+		if o.busy[k] || ctx.Err() != nil {
+			// messages added in the meantime will be picked by the next pass
+			continue
+		}
+		o.busy[k] = true
+		o.workers.Add(1)
+		go o.work(ctx, k, queue)
+	}
+}
+
+func (o *Outbox) work(ctx context.Context, key string, queue []*Message) {
+	defer o.workers.Done()
+	done := true
+	for _, m := range queue {
+		if ctx.Err() != nil || !o.deliver(ctx, m) {
+			// keep the order, next one has to wait
+			done = false
+			break
+		}
+	}
+
+	o.Lock()
+	delete(o.busy, key)
+	o.Unlock()
+	if done {
+		// new messages of this key may be waiting
+		o.notify()
+	}
+}
+
+// deliver returns true if the message is done
+func (o *Outbox) deliver(ctx context.Context, m *Message) bool {
+	now := time.Now().UTC()
+	if now.Before(m.NextAttemptAt) && !o.flushing.Load() {
+		return false
+	}
+
+	req := new(wemeet.RecorderToWeMeet)
+	if err := protojson.Unmarshal(m.Payload, req); err != nil {
+		log.Errorln(fmt.Sprintf("outbox: moving unreadable message: %s to %s, error: %s", m.Id, Failed, err.Error()))
+		m.FailedAt = &now
+		m.LastError = err.Error()
+		o.move(m, Failed)
+		return true
+	}
+
+	m.Attempts++
+	status, err := o.send(ctx, req)
+	if err == nil && isRejected(status) {
+		// retrying won't help, so the next ones don't need to wait for it
+		log.Errorln(fmt.Sprintf("outbox: server rejected task: %s for key: %s with status: %d, moving it to %s", req.Task.String(), m.Key, status, Failed))
+		m.FailedAt = &now
+		m.StatusCode = status
+		m.LastError = fmt.Sprintf("server responded with status: %d", status)
+		o.move(m, Failed)
+		return true
+	}
+	if err == nil && (status < http.StatusOK || status >= http.StatusMultipleChoices) {
+		err = fmt.Errorf("server responded with status: %d", status)
+	}
+	if err != nil {
+		backoff := utils.Backoff(m.Attempts, time.Second, o.maxBackoff)
+		m.StatusCode = status
+		m.LastError = err.Error()
+		m.NextAttemptAt = now.Add(backoff)
+		log.Warnln(fmt.Sprintf("outbox: failed to deliver task: %s for key: %s, attempt: %d, retrying in %v, error: %s", req.Task.String(), m.Key, m.Attempts, backoff, err.Error()))
+		if err := writeMessage(path.Join(o.dir, Pending), m); err != nil {
+			log.Errorln("outbox:", err)
+		}
+		return false
+	}
+
+	m.DeliveredAt = &now
+	m.StatusCode = status
+	m.LastError = ""
+	o.move(m, Delivered)
+	return true
+}
+
+// move writes m in dir & removes it from pending
+func (o *Outbox) move(m *Message, dir string) {
+	if err := writeMessage(path.Join(o.dir, dir), m); err != nil {
+		log.Errorln("outbox:", err)
+	}
+	if err := os.Remove(path.Join(o.dir, Pending, m.Id+".json")); err != nil {
+		log.Errorln("outbox:", err)
+	}
+}
+
+// isRejected returns true if the server has rejected the message itself,
+// other errors e.g. 401 during key rotation may go away
+func isRejected(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+func (o *Outbox) pruneDelivered() {
+	msgs, err := List(o.dir, Delivered)
+	if err != nil {
+		log.Errorln("outbox:", err)
+		return
+	}
+	for _, m := range msgs {
+		if m.DeliveredAt != nil && time.Since(*m.DeliveredAt) > o.keepDelivered {
+			_ = os.Remove(path.Join(o.dir, Delivered, m.Id+".json"))
+		}
+	}
+}
+
+// List returns the messages of box (Pending, Delivered or Failed) of the outbox in dir in order of creation
+func List(dir, box string) ([]*Message, error) {
+	d := path.Join(dir, box)
+
+	files, err := os.ReadDir(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var msgs []*Message
+	for _, n := range names {
+		data, err := os.ReadFile(path.Join(d, n))
+		if err != nil {
+			// may be delivered in the meantime
+			continue
+		}
+		m := new(Message)
+		if err := json.Unmarshal(data, m); err != nil {
+			log.Errorln(fmt.Sprintf("outbox: unreadable message: %s, error: %s", n, err.Error()))
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+func writeMessage(dir string, m *Message) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(path.Join(dir, m.Id+".json"), data, 0644)
+}
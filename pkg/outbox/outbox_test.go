@@ -0,0 +1,362 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// testServer records the delivered messages and replies with the next status of its script,
+// 200 once the script has finished
+type testServer struct {
+	*httptest.Server
+	sync.Mutex
+	script   []int
+	received []*wemeet.RecorderToWeMeet
+}
+
+func newTestServer(t *testing.T, script ...int) *testServer {
+	t.Helper()
+	s := &testServer{script: script}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := new(wemeet.RecorderToWeMeet)
+		if err := protojson.Unmarshal(body, req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.Lock()
+		status := http.StatusOK
+		if len(s.script) > 0 {
+			status, s.script = s.script[0], s.script[1:]
+		}
+		if status < http.StatusMultipleChoices {
+			s.received = append(s.received, req)
+		}
+		s.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) sender() Sender {
+	return func(ctx context.Context, req *wemeet.RecorderToWeMeet) (int, error) {
+		body, err := protojson.Marshal(req)
+		if err != nil {
+			return 0, err
+		}
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return 0, err
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+}
+
+func (s *testServer) messages() []string {
+	s.Lock()
+	defer s.Unlock()
+	var msgs []string
+	for _, r := range s.received {
+		msgs = append(msgs, r.Msg)
+	}
+	return msgs
+}
+
+func notification(recordingId, msg string) *wemeet.RecorderToWeMeet {
+	return &wemeet.RecorderToWeMeet{
+		From:        "recorder",
+		Status:      true,
+		Task:        wemeet.RecordingTasks_END_RECORDING,
+		Msg:         msg,
+		RecordingId: recordingId,
+	}
+}
+
+func startOutbox(t *testing.T, o *Outbox) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func count(t *testing.T, dir, box string) int {
+	t.Helper()
+	msgs, err := List(dir, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(msgs)
+}
+
+func TestOutboxOrderPerKey(t *testing.T) {
+	dir := t.TempDir()
+	// the first message of rec1 fails once, so the rest of rec1 has to wait
+	srv := newTestServer(t, http.StatusServiceUnavailable)
+	o, err := New(dir, srv.sender(), 50*time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"1", "2", "3"} {
+		if err := o.Enqueue("rec1", notification("rec1", msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	startOutbox(t, o)
+	waitFor(t, 5*time.Second, func() bool { return count(t, dir, Delivered) == 3 })
+
+	got := srv.messages()
+	want := []string{"1", "2", "3"}
+	if len(got) != len(want) {
+		t.Fatalf("received %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("received %v, want %v", got, want)
+		}
+	}
+	if count(t, dir, Pending) != 0 {
+		t.Fatal("pending messages left")
+	}
+}
+
+func TestOutboxKeysAreIndependent(t *testing.T) {
+	dir := t.TempDir()
+	block := make(chan struct{})
+	var delivered atomic.Int32
+	send := func(ctx context.Context, req *wemeet.RecorderToWeMeet) (int, error) {
+		if req.RecordingId == "slow" {
+			select {
+			case <-block:
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+		delivered.Add(1)
+		return http.StatusOK, nil
+	}
+	o, err := New(dir, send, time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(block)
+
+	_ = o.Enqueue("slow", notification("slow", "1"))
+	startOutbox(t, o)
+	time.Sleep(100 * time.Millisecond)
+	_ = o.Enqueue("fast", notification("fast", "1"))
+
+	waitFor(t, 3*time.Second, func() bool { return delivered.Load() == 1 })
+}
+
+func TestOutboxRetries(t *testing.T) {
+	tests := []struct {
+		name   string
+		script []int
+		// the first attempt fails in transport
+		transportErr bool
+	}{
+		{name: "server error", script: []int{http.StatusInternalServerError, http.StatusBadGateway}},
+		{name: "too many requests", script: []int{http.StatusTooManyRequests}},
+		{name: "unauthorized", script: []int{http.StatusUnauthorized, http.StatusNotFound}},
+		{name: "transport error", transportErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			srv := newTestServer(t, tt.script...)
+			var calls atomic.Int32
+			send := func(ctx context.Context, req *wemeet.RecorderToWeMeet) (int, error) {
+				if calls.Add(1) == 1 && tt.transportErr {
+					return 0, errors.New("connection refused")
+				}
+				return srv.sender()(ctx, req)
+			}
+			o, err := New(dir, send, 50*time.Millisecond, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_ = o.Enqueue("rec1", notification("rec1", "end"))
+			// a single pass, so the state after the first failure can be checked
+			o.startWorkers(context.Background())
+			o.workers.Wait()
+			msgs, _ := List(dir, Pending)
+			if len(msgs) != 1 {
+				t.Fatalf("pending = %d, want 1", len(msgs))
+			}
+			if msgs[0].Attempts != 1 || msgs[0].LastError == "" || !msgs[0].NextAttemptAt.After(msgs[0].CreatedAt) {
+				t.Fatalf("unexpected state after failure: %+v", msgs[0])
+			}
+
+			startOutbox(t, o)
+			waitFor(t, 5*time.Second, func() bool { return count(t, dir, Delivered) == 1 })
+			delivered, _ := List(dir, Delivered)
+			want := len(tt.script) + 1
+			if tt.transportErr {
+				want = 2
+			}
+			if delivered[0].Attempts != want || delivered[0].StatusCode != http.StatusOK {
+				t.Fatalf("attempts = %d, status = %d, want %d attempts and 200", delivered[0].Attempts, delivered[0].StatusCode, want)
+			}
+		})
+	}
+}
+
+func TestOutboxRejectedMessageIsFailed(t *testing.T) {
+	dir := t.TempDir()
+	srv := newTestServer(t, http.StatusBadRequest)
+	o, err := New(dir, srv.sender(), 50*time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = o.Enqueue("rec1", notification("rec1", "invalid"))
+	_ = o.Enqueue("rec1", notification("rec1", "next"))
+	startOutbox(t, o)
+	waitFor(t, 5*time.Second, func() bool { return count(t, dir, Delivered) == 1 })
+
+	failed, _ := List(dir, Failed)
+	if len(failed) != 1 || failed[0].StatusCode != http.StatusBadRequest || failed[0].FailedAt == nil {
+		t.Fatalf("unexpected failed messages: %+v", failed)
+	}
+	if got := srv.messages(); len(got) != 1 || got[0] != "next" {
+		t.Fatalf("received %v, want [next]", got)
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	srv := newTestServer(t)
+
+	// never started, like a recorder killed before the delivery
+	o, err := New(dir, srv.sender(), time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = o.Enqueue("rec1", notification("rec1", "1"))
+	_ = o.Enqueue("rec1", notification("rec1", "2"))
+
+	o, err = New(dir, srv.sender(), time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Pending() != 2 {
+		t.Fatalf("pending = %d, want 2", o.Pending())
+	}
+	startOutbox(t, o)
+	waitFor(t, 5*time.Second, func() bool { return count(t, dir, Delivered) == 2 })
+	if got := srv.messages(); len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Fatalf("received %v, want [1 2]", got)
+	}
+}
+
+func TestOutboxFlush(t *testing.T) {
+	dir := t.TempDir()
+	srv := newTestServer(t, http.StatusServiceUnavailable)
+	// without flush the retry would wait for an hour
+	o, err := New(dir, srv.sender(), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = o.Enqueue("rec1", notification("rec1", "end"))
+	o.startWorkers(context.Background())
+	o.workers.Wait()
+	if o.Pending() != 1 {
+		t.Fatal("first attempt should have failed")
+	}
+
+	startOutbox(t, o)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := o.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count(t, dir, Delivered) != 1 {
+		t.Fatal("message wasn't delivered")
+	}
+}
+
+func TestOutboxFlushTimeout(t *testing.T) {
+	dir := t.TempDir()
+	srv := newTestServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	o, err := New(dir, srv.sender(), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = o.Enqueue("rec1", notification("rec1", "end"))
+	startOutbox(t, o)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := o.Flush(ctx); err == nil {
+		t.Fatal("flush should fail while the server is down")
+	}
+	if o.Pending() != 1 {
+		t.Fatal("message must stay pending")
+	}
+}
+
+func TestOutboxPruneDelivered(t *testing.T) {
+	dir := t.TempDir()
+	o, err := New(dir, newTestServer(t).sender(), time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().UTC().Add(-2 * time.Hour)
+	recent := time.Now().UTC()
+	for id, at := range map[string]time.Time{"old": old, "recent": recent} {
+		m := &Message{Id: id, Key: "rec1", Payload: []byte("{}"), DeliveredAt: &at}
+		if err := writeMessage(path.Join(dir, Delivered), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	o.pruneDelivered()
+	if _, err := os.Stat(path.Join(dir, Delivered, "old.json")); !os.IsNotExist(err) {
+		t.Fatal("old message wasn't pruned")
+	}
+	if _, err := os.Stat(path.Join(dir, Delivered, "recent.json")); err != nil {
+		t.Fatal("recent message was pruned")
+	}
+}
@@ -0,0 +1,48 @@
+package recorder
+
+import (
+	"fmt"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+// IsAudioOnly returns true if the recording of req should contain only audio.
+// The setting of room_overrides has priority over audio_only.
+func IsAudioOnly(appCnf *config.AppConfig, req *wemeet.WeMeetToRecorder) bool {
+	if req.Task != wemeet.RecordingTasks_START_RECORDING {
+		// live outputs always need video
+		return false
+	}
+	if o, ok := appCnf.Recorder.RoomOverrides[req.GetRoomId()]; ok && o.AudioOnly != nil {
+		return *o.AudioOnly
+	}
+	return appCnf.Recorder.AudioOnly.Enabled
+}
+
+// audioOnlyWidth & audioOnlyHeight are the size of the display of an audio only session,
+// it's never captured, so it only needs to be large enough for the client to join
+const (
+	audioOnlyWidth  = 640
+	audioOnlyHeight = 360
+)
+
+// AudioOnly returns true if this session was started with a minimal virtual display
+// which isn't captured, so outputs which need video can't be attached to it
+func (r *Recorder) AudioOnly() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.audioOnly
+}
+
+func (r *Recorder) audioOnlyFileName(req *wemeet.WeMeetToRecorder) string {
+	return fmt.Sprintf("%s_raw.%s", req.GetRecordingId(), r.AppCnf.Recorder.AudioOnly.Format)
+}
+
+// windowSize returns the size of the display & the window of chrome
+func (r *Recorder) windowSize() (int, int) {
+	if r.audioOnly {
+		return audioOnlyWidth, audioOnlyHeight
+	}
+	return int(r.AppCnf.Recorder.Width), int(r.AppCnf.Recorder.Height)
+}
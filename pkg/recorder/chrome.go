@@ -10,12 +10,17 @@ import (
 
 	"github.com/chromedp/cdproto/target"
 	"github.com/chromedp/chromedp"
-	log "github.com/sirupsen/logrus"
+	"github.com/retawsolit/WeMeet-recorder/pkg/metrics"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // launch Chrome to access URL
 func (r *Recorder) launchChrome() {
-	log.Infof("launching chrome for task: %s, with url: %s", r.Req.Task.String(), r.joinUrl)
+	r.Lock()
+	gen := r.chromeGen
+	r.Unlock()
+	r.logger.Infof("launching chrome for task: %s, with url: %s", r.Req.Task.String(), r.joinUrl)
 
 	opts := []chromedp.ExecAllocatorOption{
 		// ---- Performance & Stability Flags ----
@@ -48,16 +53,22 @@ func (r *Recorder) launchChrome() {
 		chromedp.Flag("disable-notifications", true),
 		chromedp.Flag("autoplay-policy", "no-user-gesture-required"),
 		chromedp.Flag("window-position", "0,0"),
-		chromedp.Flag("window-size", fmt.Sprintf("%d,%d", r.AppCnf.Recorder.Width, r.AppCnf.Recorder.Height)),
 		chromedp.Flag("force-device-scale-factor", "1"),
 
 		// ---- Environment & Rendering Flags ----
 		chromedp.NoSandbox,
 		chromedp.Flag("force-color-profile", "srgb"),
 		chromedp.Env(fmt.Sprintf("PULSE_SINK=%s", r.pulseSinkName)),
-		chromedp.Flag("display", r.displayId),
 	}
 
+	// audio only runs headful on a minimal display as well,
+	// so the client behaves the same as for video, e.g. autoplay of the audio
+	width, height := r.windowSize()
+	opts = append(opts,
+		chromedp.Flag("window-size", fmt.Sprintf("%d,%d", width, height)),
+		chromedp.Flag("display", r.displayId),
+	)
+
 	if r.AppCnf.Recorder.CustomChromePath != nil && *r.AppCnf.Recorder.CustomChromePath != "" {
 		opts = append(opts, chromedp.ExecPath(*r.AppCnf.Recorder.CustomChromePath))
 	}
@@ -66,6 +77,7 @@ func (r *Recorder) launchChrome() {
 	chromeCtx, chromeCancel := chromedp.NewContext(allocCtx)
 
 	r.Lock()
+	r.chromeCtx = chromeCtx
 	r.closeChrome = func() {
 		chromeCancel()
 		allocCancel()
@@ -73,86 +85,171 @@ func (r *Recorder) launchChrome() {
 	r.Unlock()
 
 	chromedp.ListenBrowser(chromeCtx, func(ev interface{}) {
+		// listener must not block, so recovery will run in goroutine
 		switch ev.(type) {
 		case *target.EventDetachedFromTarget:
-			log.Infof("browser detached from target for task: %s, roomTableId: %d", r.Req.Task.String(), r.Req.GetRoomTableId())
-			r.Close(errors.New("browser detached from target unexpectedly"))
+			r.logger.Infof("browser detached from target for task: %s, roomTableId: %d", r.Req.Task.String(), r.Req.GetRoomTableId())
+			metrics.ProcessExits.WithLabelValues("chrome", "detached").Inc()
+			go r.recoverChrome(gen, errors.New("browser detached from target unexpectedly"))
 		case *target.EventTargetCrashed:
-			log.Infof("browser crashed for task: %s, roomTableId: %d", r.Req.Task.String(), r.Req.GetRoomTableId())
-			r.Close(errors.New("browser crashed"))
+			r.logger.Infof("browser crashed for task: %s, roomTableId: %d", r.Req.Task.String(), r.Req.GetRoomTableId())
+			metrics.ProcessExits.WithLabelValues("chrome", "crashed").Inc()
+			go r.recoverChrome(gen, errors.New("browser crashed"))
 		}
 	})
 
+	// until the room was joined, or rejoined after recovery
+	spanName := "chrome join"
+	if r.isJoined() {
+		spanName = "chrome rejoin"
+	}
+	joinCtx, joinSpan := tracing.Start(r.TraceCtx, spanName, attribute.Int("chrome.generation", gen))
+	joinEnded := false
+	endJoin := func(err error) {
+		if !joinEnded {
+			joinEnded = true
+			tracing.End(joinSpan, err)
+		}
+	}
+
 	var currentURL, title string
 
 	err := chromedp.Run(chromeCtx,
-		chromedp.Navigate(r.joinUrl),
+		r.traceAction(joinCtx, "chrome navigate", chromedp.Navigate(r.joinUrl)),
 		chromedp.Location(&currentURL),
 		chromedp.Title(&title),
 		chromedp.ActionFunc(func(ctx context.Context) error {
-			log.Infof("recorder joinUrl=%s", r.joinUrl)
-			log.Infof("after navigate currentURL=%s title=%s", currentURL, title)
+			r.logger.Infof("recorder joinUrl=%s", r.joinUrl)
+			r.logger.Infof("after navigate currentURL=%s title=%s", currentURL, title)
+			if c := chromedp.FromContext(ctx); c != nil && c.Browser != nil && c.Browser.Process() != nil {
+				r.Lock()
+				r.chromePid = c.Browser.Process().Pid
+				r.Unlock()
+				r.reportState()
+			}
 			return nil
 		}),
-		r.waitVisibleWithTimeout("div[id=startupJoinModal]", waitForSelectorTimeout),
-		chromedp.Click("button[id=listenOnlyJoin]", chromedp.NodeVisible),
-		r.waitVisibleWithTimeout("div[id=main-area]", waitForSelectorTimeout),
+		r.waitVisibleWithTimeout(joinCtx, "div[id=startupJoinModal]", waitForSelectorTimeout),
+		r.traceAction(joinCtx, "chrome click join", chromedp.Click("button[id=listenOnlyJoin]", chromedp.NodeVisible)),
+		r.waitVisibleWithTimeout(joinCtx, "div[id=main-area]", waitForSelectorTimeout),
+		// needs to be applied again after every recovery
+		r.traceAction(joinCtx, "apply recording variant", r.applyRecordingVariant()),
 		chromedp.ActionFunc(func(context.Context) error {
+			endJoin(nil)
+			if r.isJoined() {
+				// we have rejoined after recovery, ffmpeg was capturing the display all along
+				r.logger.Infof("chrome recovered for task: %s, roomTableId: %d", r.Req.Task.String(), r.Req.GetRoomTableId())
+				r.emitSessionEvent(EventChromeRecovered, nil)
+				return nil
+			}
+			r.emitSessionEvent(EventJoinedRoom, nil)
 			time.Sleep(time.Second * 3)
-			return r.launchFfmpegProcess(path.Join(r.filePath, r.fileName))
+			r.launchPendingOutputs()
+			return nil
 		}),
 		chromedp.WaitVisible("div[id=errorPage]"),
 		chromedp.ActionFunc(func(context.Context) error {
-			log.Infoln("got closing tag, so closing recorder now")
+			r.logger.Infoln("got closing tag, so closing recorder now")
 			r.Close(nil)
 			return nil
 		}),
 	)
+	endJoin(err)
 	if err != nil {
+		if r.isStaleChrome(gen) {
+			// this chrome was replaced during recovery
+			return
+		}
 		if !errors.Is(err, context.Canceled) {
-			log.Errorln("chrome:", err)
+			r.logger.Errorln("chrome:", err)
 
 			var buf []byte
 			if shotErr := chromedp.Run(chromeCtx, chromedp.FullScreenshot(&buf, 90)); shotErr == nil {
-				screenshotPath := path.Join(r.filePath, "debug-timeout.png")
+				screenshotPath := path.Join(r.debugDir, "debug-timeout.png")
 				if writeErr := os.WriteFile(screenshotPath, buf, 0644); writeErr != nil {
-					log.Errorf("failed to save screenshot: %v", writeErr)
+					r.logger.Errorf("failed to save screenshot: %v", writeErr)
 				} else {
-					log.Infof("saved screenshot to %s", screenshotPath)
+					r.logger.Infof("saved screenshot to %s", screenshotPath)
 				}
 			} else {
-				log.Errorf("failed to capture screenshot: %v", shotErr)
+				r.logger.Errorf("failed to capture screenshot: %v", shotErr)
 			}
 
 			var html string
 			if htmlErr := chromedp.Run(chromeCtx, chromedp.OuterHTML("html", &html, chromedp.ByQuery)); htmlErr == nil {
-				htmlPath := path.Join(r.filePath, "debug-timeout.html")
+				htmlPath := path.Join(r.debugDir, "debug-timeout.html")
 				if writeErr := os.WriteFile(htmlPath, []byte(html), 0644); writeErr != nil {
-					log.Errorf("failed to save html dump: %v", writeErr)
+					r.logger.Errorf("failed to save html dump: %v", writeErr)
 				} else {
-					log.Infof("saved html dump to %s", htmlPath)
+					r.logger.Infof("saved html dump to %s", htmlPath)
 				}
 			} else {
-				log.Errorf("failed to capture html dump: %v", htmlErr)
+				r.logger.Errorf("failed to capture html dump: %v", htmlErr)
 			}
 		}
+		if r.isJoined() {
+			// failed while rejoining, so we can try again if recoveries are left
+			r.recoverChrome(gen, err)
+			return
+		}
 		r.Close(err)
 	}
 }
 
+// recoverChrome will relaunch chrome on the same display & pulse sink
+// and rejoin the room, while ffmpeg keeps capturing.
+// Once max_chrome_recoveries is reached the recorder will be closed.
+func (r *Recorder) recoverChrome(gen int, reason error) {
+	r.Lock()
+	if r.closed || gen != r.chromeGen {
+		// already handled for this chrome
+		r.Unlock()
+		return
+	}
+	if r.chromeRecoveries >= r.AppCnf.Recorder.MaxChromeRecoveries {
+		r.Unlock()
+		r.Close(reason)
+		return
+	}
+	r.chromeRecoveries++
+	r.chromeGen++
+	attempt := r.chromeRecoveries
+	closeChrome := r.closeChrome
+	r.closeChrome = nil
+	r.Unlock()
+
+	r.logger.Warnln(fmt.Sprintf("recovering chrome (%d/%d) for task: %s, roomTableId: %d, reason: %s", attempt, r.AppCnf.Recorder.MaxChromeRecoveries, r.Req.Task.String(), r.Req.GetRoomTableId(), reason.Error()))
+	r.emitSessionEvent(EventChromeRecovery, map[string]string{
+		"attempt": fmt.Sprintf("%d", attempt),
+		"reason":  reason.Error(),
+	})
+	if closeChrome != nil {
+		closeChrome()
+	}
+
+	go r.launchChrome()
+}
+
+func (r *Recorder) isStaleChrome(gen int) bool {
+	r.Lock()
+	defer r.Unlock()
+	return gen != r.chromeGen
+}
+
 func (r *Recorder) closeChromeDp() {
 	r.Lock()
 	defer r.Unlock()
 
 	if r.closeChrome != nil {
-		log.Infof("closing chrome for task: %s, roomTableId: %d", r.Req.Task.String(), r.Req.GetRoomTableId())
+		r.logger.Infof("closing chrome for task: %s, roomTableId: %d", r.Req.Task.String(), r.Req.GetRoomTableId())
 		r.closeChrome()
 		r.closeChrome = nil
 	}
 }
 
-func (r *Recorder) waitVisibleWithTimeout(selector string, timeout time.Duration) chromedp.ActionFunc {
+func (r *Recorder) waitVisibleWithTimeout(traceCtx context.Context, selector string, timeout time.Duration) chromedp.ActionFunc {
 	return func(ctx context.Context) error {
+		_, span := tracing.Start(traceCtx, "chrome wait visible", attribute.String("chrome.selector", selector))
 		timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 
@@ -160,6 +257,38 @@ func (r *Recorder) waitVisibleWithTimeout(selector string, timeout time.Duration
 		if err != nil && errors.Is(err, context.DeadlineExceeded) {
 			err = fmt.Errorf("%s was not visible after %v", selector, timeout)
 		}
+		tracing.End(span, err)
 		return err
 	}
 }
+
+// traceAction runs action in a span of traceCtx
+func (r *Recorder) traceAction(traceCtx context.Context, name string, action chromedp.Action) chromedp.ActionFunc {
+	return func(ctx context.Context) error {
+		_, span := tracing.Start(traceCtx, name)
+		err := action.Do(ctx)
+		tracing.End(span, err)
+		return err
+	}
+}
+
+// Screenshot captures the current page of the session in jpeg
+func (r *Recorder) Screenshot(timeout time.Duration, quality int) ([]byte, error) {
+	r.Lock()
+	chromeCtx := r.chromeCtx
+	closed := r.closed
+	r.Unlock()
+	if closed || chromeCtx == nil || chromeCtx.Err() != nil {
+		return nil, errors.New("chrome is not running")
+	}
+
+	// must not cancel the browser
+	ctx, cancel := context.WithTimeout(chromeCtx, timeout)
+	defer cancel()
+
+	var buf []byte
+	if err := chromedp.Run(ctx, chromedp.FullScreenshot(&buf, quality)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
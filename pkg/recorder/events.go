@@ -0,0 +1,38 @@
+package recorder
+
+import "github.com/retawsolit/wemeet-protocol/wemeet"
+
+// internal events of a session, in addition to the notifications sent to the server
+const (
+	EventJoinedRoom      = "joined_room"
+	EventChromeRecovery  = "chrome_recovery"
+	EventChromeRecovered = "chrome_recovered"
+	EventFfmpegRestarted = "ffmpeg_restarted"
+	EventFfmpegStalled   = "ffmpeg_stalled"
+)
+
+// emitEvent calls OnEventCallback for a single output
+func (r *Recorder) emitEvent(req *wemeet.WeMeetToRecorder, event string, details map[string]string) {
+	if r.OnEventCallback == nil {
+		return
+	}
+	r.OnEventCallback(req, event, details)
+}
+
+// emitSessionEvent calls OnEventCallback for every output of the session
+func (r *Recorder) emitSessionEvent(event string, details map[string]string) {
+	if r.OnEventCallback == nil {
+		return
+	}
+
+	r.Lock()
+	reqs := make([]*wemeet.WeMeetToRecorder, 0, len(r.outputs))
+	for _, o := range r.outputs {
+		reqs = append(reqs, o.req)
+	}
+	r.Unlock()
+
+	for _, req := range reqs {
+		r.OnEventCallback(req, event, details)
+	}
+}
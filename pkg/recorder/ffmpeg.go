@@ -5,95 +5,225 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
+	"time"
 
+	"github.com/retawsolit/WeMeet-recorder/pkg/metrics"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tracing"
+	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
 	"github.com/retawsolit/wemeet-protocol/wemeet"
-	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"mvdan.cc/sh/v3/shell"
 )
 
-func (r *Recorder) launchFfmpegProcess(mp4File string) error {
-	var args []string
+func (r *Recorder) buildFfmpegArgs(o *sessionOutput) ([]string, error) {
+	// machine-readable progress on stdout, for stats & stall detection
+	args := []string{"-progress", "pipe:1", "-nostats"}
 	var preInput, postInput string
 
-	if r.Req.Task == wemeet.RecordingTasks_START_RTMP {
+	if o.req.Task == wemeet.RecordingTasks_START_RTMP {
 		preInput = r.AppCnf.FfmpegSettings.Rtmp.PreInput
 		postInput = r.AppCnf.FfmpegSettings.Rtmp.PostInput
-	} else if r.Req.Task == wemeet.RecordingTasks_START_RECORDING {
+	} else if o.req.Task == wemeet.RecordingTasks_START_RECORDING {
 		preInput = r.AppCnf.FfmpegSettings.Recording.PreInput
 		postInput = r.AppCnf.FfmpegSettings.Recording.PostInput
+		if o.audioOnly {
+			preInput = r.AppCnf.FfmpegSettings.AudioOnlyRecording.PreInput
+			postInput = r.AppCnf.FfmpegSettings.AudioOnlyRecording.PostInput
+		} else if o.segmented {
+			preInput = r.AppCnf.FfmpegSettings.SegmentedRecording.PreInput
+			postInput = r.AppCnf.FfmpegSettings.SegmentedRecording.PostInput
+		}
 	} else {
-		return fmt.Errorf("invalid task %s received", r.Req.Task.String())
+		return nil, fmt.Errorf("invalid task %s received", o.req.Task.String())
 	}
 
 	preArgs, err := shell.Fields(preInput, nil)
 	if err != nil {
-		return fmt.Errorf("failed to parse ffmpeg pre-input args: %w", err)
+		return nil, fmt.Errorf("failed to parse ffmpeg pre-input args: %w", err)
 	}
 	args = append(args, preArgs...)
 
+	// streams of our inputs, pre_input may have added its own inputs before them
+	input := countInputs(preArgs)
+	var maps []string
+	if !o.audioOnly {
+		args = append(args,
+			"-video_size", fmt.Sprintf("%dx%d", r.AppCnf.Recorder.Width, r.AppCnf.Recorder.Height),
+			"-f", "x11grab",
+			"-i", r.displayId,
+		)
+		maps = append(maps, fmt.Sprintf("%d:v", input))
+		input++
+	}
 	args = append(args,
-		"-video_size", fmt.Sprintf("%dx%d", r.AppCnf.Recorder.Width, r.AppCnf.Recorder.Height),
-		"-f", "x11grab",
-		"-i", r.displayId,
 		"-f", "pulse",
 		"-i", fmt.Sprintf("%s.monitor", r.pulseSinkName),
 	)
+	maps = append(maps, fmt.Sprintf("%d:a", input))
 
 	postArgs, err := shell.Fields(postInput, nil)
 	if err != nil {
-		return fmt.Errorf("failed to parse ffmpeg post-input args: %w", err)
+		return nil, fmt.Errorf("failed to parse ffmpeg post-input args: %w", err)
 	}
 	args = append(args, postArgs...)
 
-	if r.Req.Task == wemeet.RecordingTasks_START_RTMP {
-		args = append(args, *r.Req.RtmpUrl)
+	r.Lock()
+	filePath, fileName, attempt := o.filePath, o.currentFileName(), o.ffmpegRestarts
+	r.Unlock()
+
+	if o.req.Task == wemeet.RecordingTasks_START_RTMP {
+		if len(o.relays) > 0 {
+			args = append(args, r.teeOutputArgs(o, maps)...)
+		} else {
+			// protocol options come last, so they'll override the muxer of post_input
+			outputArgs, err := outputProtocolArgs(r.AppCnf.FfmpegSettings, o.destinations[0])
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, outputArgs...)
+		}
+	} else if o.segmented {
+		segmentArgs, err := r.segmentOutputArgs(o.req, filePath, fileName, attempt)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, segmentArgs...)
 	} else {
-		args = append(args, mp4File)
+		args = append(args, path.Join(filePath, fileName))
+	}
+
+	return args, nil
+}
+
+// countInputs returns the number of inputs in args
+func countInputs(args []string) int {
+	n := 0
+	for _, a := range args {
+		if a == "-i" {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *Recorder) startFfmpeg(o *sessionOutput) error {
+	args, err := r.buildFfmpegArgs(o)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.closed || o.stopped {
+		return errors.New("ffmpeg: output was closed")
 	}
 
-	log.Infoln(fmt.Sprintf("starting ffmpeg process for Task: %s with args: %s", r.Req.Task.String(), strings.Join(args, " ")))
+	o.logger.Infoln(fmt.Sprintf("starting ffmpeg process for Task: %s with args: %s", o.req.Task.String(), strings.Join(args, " ")))
 
 	ffmpegCmd := exec.CommandContext(r.ctx, "ffmpeg", args...)
-	ffmpegCmd.Stderr = &infoLogger{cmd: "ffmpeg"}
+	ffmpegCmd.Stderr = &infoLogger{cmd: "ffmpeg", logger: o.logger}
+	ffmpegCmd.Stdout = &progressWriter{r: r, o: o, ffmpegCmd: ffmpegCmd}
 	if err := ffmpegCmd.Start(); err != nil {
 		return errors.New("ffmpeg: " + err.Error())
 	}
+	o.ffmpegCmd = ffmpegCmd
+	// a new process starts from zero
+	o.progress = nil
+	o.stalled = false
+	o.outTimeAdvancedAt = time.Now().UTC()
+
+	done := make(chan struct{})
+	go r.superviseFfmpeg(o, ffmpegCmd, done)
+	go r.watchFfmpegStall(o, ffmpegCmd, done)
+	return nil
+}
+
+// superviseFfmpeg waits for the ffmpeg process to exit
+// and restarts it with a new output part if it wasn't stopped by us,
+// done will be closed after the exit
+func (r *Recorder) superviseFfmpeg(o *sessionOutput, ffmpegCmd *exec.Cmd, done chan struct{}) {
+	err := ffmpegCmd.Wait()
+	close(done)
+
 	r.Lock()
-	r.ffmpegCmd = ffmpegCmd
+	// closeFfmpeg will unset it before stopping
+	stopped := o.ffmpegCmd != ffmpegCmd
 	r.Unlock()
+	if err == nil || stopped {
+		return
+	}
 
-	go func() {
-		err := r.ffmpegCmd.Wait()
-		if err != nil {
-			var exitErr *exec.ExitError
-			if errors.As(err, &exitErr) {
-				if exitErr.ExitCode() != -1 && exitErr.ExitCode() != 255 {
-					log.Errorln(fmt.Errorf("ffmpeg exited with code: %d for task: %s, roomTableId: %d", exitErr.ExitCode(), r.Req.Task.String(), r.Req.GetRoomTableId()))
-				}
-			}
-			r.Close(err)
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+		metrics.ProcessExits.WithLabelValues("ffmpeg", fmt.Sprintf("%d", exitCode)).Inc()
+		if exitCode != -1 && exitCode != 255 {
+			o.logger.Errorln(fmt.Errorf("ffmpeg exited with code: %d for task: %s, roomTableId: %d", exitCode, o.req.Task.String(), o.req.GetRoomTableId()))
 		}
-	}()
+	}
 
-	// so, if everything goes well then we can make callback
-	if r.OnAfterStartCallback != nil {
-		r.OnAfterStartCallback(r.Req)
+	settings := r.AppCnf.Recorder.FfmpegRestart
+	r.Lock()
+	if o.ffmpegRestarts >= settings.MaxRestarts {
+		r.Unlock()
+		// only this output is affected, others can continue
+		r.DetachOutput(o.req.Task, err)
+		return
 	}
-	return nil
+	o.ffmpegRestarts++
+	attempt := o.ffmpegRestarts
+	o.ffmpegCmd = nil
+	r.Unlock()
+
+	backoff := utils.Backoff(attempt, time.Duration(settings.Backoff)*time.Second, time.Duration(settings.MaxBackoff)*time.Second)
+	o.logger.Warnln(fmt.Sprintf("restarting ffmpeg (%d/%d) in %v for task: %s, roomTableId: %d, exit code: %d", attempt, settings.MaxRestarts, backoff, o.req.Task.String(), o.req.GetRoomTableId(), exitCode))
+
+	select {
+	case <-r.ctx.Done():
+		return
+	case <-time.After(backoff):
+	}
+
+	if o.req.Task == wemeet.RecordingTasks_START_RECORDING && !o.segmented {
+		// never overwrite the part written by the previous process
+		r.Lock()
+		o.fileNames = append(o.fileNames, fmt.Sprintf("%s_raw_part%d%s", o.req.GetRecordingId(), attempt, path.Ext(o.fileNames[0])))
+		r.Unlock()
+	}
+
+	_, span := tracing.Start(o.traceCtx, "ffmpeg restart", attribute.Int("ffmpeg.attempt", attempt), attribute.Int("ffmpeg.exit_code", exitCode))
+	err = r.startFfmpeg(o)
+	tracing.End(span, err)
+	if err != nil {
+		o.logger.Errorln(err)
+		r.DetachOutput(o.req.Task, err)
+		return
+	}
+	// new process & part
+	r.reportState()
+	r.emitEvent(o.req, EventFfmpegRestarted, map[string]string{
+		"attempt":   fmt.Sprintf("%d", attempt),
+		"exit_code": fmt.Sprintf("%d", exitCode),
+	})
 }
 
-func (r *Recorder) closeFfmpeg() {
+func (r *Recorder) closeFfmpeg(o *sessionOutput) {
 	r.Lock()
 	defer r.Unlock()
 
-	if r.ffmpegCmd != nil {
-		log.Infoln(fmt.Sprintf("closing ffmpeg for task: %s, roomTableId: %d", r.Req.Task.String(), r.Req.GetRoomTableId()))
+	// no restart after this point
+	o.stopped = true
+	r.closeRtmpRelays(o)
+	if o.ffmpegCmd != nil {
+		o.logger.Infoln(fmt.Sprintf("closing ffmpeg for task: %s, roomTableId: %d", o.req.Task.String(), o.req.GetRoomTableId()))
 
-		if err := r.ffmpegCmd.Process.Signal(os.Interrupt); err != nil && !errors.Is(err, os.ErrProcessDone) {
-			log.Errorln("failed to interrupt ffmpeg:", err.Error(), "so, trying to kill")
-			_ = r.ffmpegCmd.Process.Kill()
+		if err := o.ffmpegCmd.Process.Signal(os.Interrupt); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			o.logger.Errorln("failed to interrupt ffmpeg:", err.Error(), "so, trying to kill")
+			_ = o.ffmpegCmd.Process.Kill()
 		}
-		r.ffmpegCmd = nil
+		o.ffmpegCmd = nil
 	}
 }
@@ -0,0 +1,257 @@
+package recorder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tracing"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrSessionClosed will be returned if an output was attached to a closed session
+var ErrSessionClosed = errors.New("recorder session was closed")
+
+// Output describes the files produced by a recorder
+type Output struct {
+	FilePath string
+	// in recording order, there will be more than one part if ffmpeg was restarted
+	FileNames      []string
+	FfmpegRestarts int
+	// the files contain only audio
+	AudioOnly        bool
+	RecordingVariant wemeet.CloudRecordingVariants
+	// zero if the output was never started
+	StartedAt time.Time
+}
+
+// sessionOutput is a ffmpeg process writing the captured session
+// to a file or a stream for a single task
+type sessionOutput struct {
+	req       *wemeet.WeMeetToRecorder
+	filePath  string
+	fileNames []string
+	// for rtmp, relays will be used if there are multiple destinations
+	destinations []string
+	relays       []*rtmpRelay
+	// states of the relays which were reported last time
+	reportedDestinations      string
+	destinationsReportedAt    time.Time
+	destinationsReportPending bool
+	localHlsDir               string
+	audioOnly                 bool
+	segmented                 bool
+
+	ffmpegCmd      *exec.Cmd
+	ffmpegRestarts int
+	launched       bool
+	stopped        bool
+	// when ffmpeg was started for the first time
+	startedAt time.Time
+	// reported by the current ffmpeg process, nil until the first report
+	progress          *FfmpegProgress
+	outTimeAdvancedAt time.Time
+	stalled           bool
+	// parent of the spans of req
+	traceCtx context.Context
+	// tagged with the fields of req
+	logger *log.Entry
+}
+
+// currentFileName returns the part ffmpeg is writing to
+func (o *sessionOutput) currentFileName() string {
+	if len(o.fileNames) == 0 {
+		return ""
+	}
+	return o.fileNames[len(o.fileNames)-1]
+}
+
+func (r *Recorder) prepareOutput(o *sessionOutput) error {
+	if o.req.Task == wemeet.RecordingTasks_START_RTMP {
+		return r.prepareRtmpRelays(o)
+	}
+	if o.req.Task != wemeet.RecordingTasks_START_RECORDING {
+		return nil
+	}
+
+	filePath := OutputDir(r.AppCnf, o.req)
+	if err := os.MkdirAll(filePath, 0755); err != nil {
+		return err
+	}
+	audioOnly := IsAudioOnly(r.AppCnf, o.req)
+	// audio files are small, so segments aren't used for them
+	segmented := r.AppCnf.Recorder.SegmentedRecording.Enabled && !audioOnly
+
+	fileName := o.req.GetRecordingId() + "_raw.mp4"
+	switch {
+	case audioOnly:
+		fileName = r.audioOnlyFileName(o.req)
+	case segmented:
+		fileName = o.req.GetRecordingId() + SegmentListSuffix
+	}
+
+	r.Lock()
+	o.filePath = filePath
+	o.fileNames = []string{fileName}
+	o.audioOnly = audioOnly
+	o.segmented = segmented
+	r.Unlock()
+
+	return nil
+}
+
+// OutputDir returns where the recording of req will be written,
+// empty if the task has no file
+func OutputDir(appCnf *config.AppConfig, req *wemeet.WeMeetToRecorder) string {
+	if req.Task != wemeet.RecordingTasks_START_RECORDING {
+		return ""
+	}
+	return path.Join(appCnf.Recorder.CopyToPath.MainPath, appCnf.Recorder.CopyToPath.SubPath, req.GetRoomId())
+}
+
+// AttachOutput will add a new output for req to this running session,
+// e.g. rtmp to a room which is already being recorded.
+// ffmpeg will be started immediately if the room was already joined.
+func (r *Recorder) AttachOutput(ctx context.Context, req *wemeet.WeMeetToRecorder) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	o := &sessionOutput{req: req, traceCtx: ctx, logger: tasklog.Entry(req)}
+
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return ErrSessionClosed
+	}
+	if _, ok := r.outputs[req.Task]; ok {
+		r.Unlock()
+		return fmt.Errorf("output for task %s already exists", req.Task.String())
+	}
+	if r.audioOnly && !IsAudioOnly(r.AppCnf, req) {
+		r.Unlock()
+		return fmt.Errorf("output for task %s needs video but the session is audio only", req.Task.String())
+	}
+	r.outputs[req.Task] = o
+	r.Unlock()
+
+	o.logger.Infoln(fmt.Sprintf("attaching output for task: %s to session of task: %s, roomTableId: %d", req.Task.String(), r.Req.Task.String(), req.GetRoomTableId()))
+	if err := r.prepareOutput(o); err != nil {
+		r.DetachOutput(req.Task, err)
+		return err
+	}
+
+	r.Lock()
+	launchNow := r.joined && !o.launched && !o.stopped
+	if launchNow {
+		o.launched = true
+	}
+	r.Unlock()
+
+	if launchNow {
+		go r.launchOutput(o)
+	}
+	return nil
+}
+
+// DetachOutput will stop the output of the task without disturbing others.
+// If it was the last output then the whole session will be closed.
+func (r *Recorder) DetachOutput(task wemeet.RecordingTasks, err error) {
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return
+	}
+	o, ok := r.outputs[task]
+	if !ok {
+		r.Unlock()
+		return
+	}
+	if len(r.outputs) == 1 {
+		r.Unlock()
+		r.Close(err)
+		return
+	}
+	delete(r.outputs, task)
+	r.Unlock()
+
+	o.logger.Infoln(fmt.Sprintf("detaching output for task: %s from session of task: %s, roomTableId: %d", task.String(), r.Req.Task.String(), o.req.GetRoomTableId()))
+	_, span := tracing.Start(o.traceCtx, "output close")
+	r.closeFfmpeg(o)
+	tracing.End(span, err)
+	r.afterOutputClosed(o, err)
+}
+
+// launchPendingOutputs starts ffmpeg for all the outputs after joining the room
+func (r *Recorder) launchPendingOutputs() {
+	r.Lock()
+	r.joined = true
+	var pending []*sessionOutput
+	for _, o := range r.outputs {
+		if !o.launched {
+			o.launched = true
+			pending = append(pending, o)
+		}
+	}
+	r.Unlock()
+
+	for _, o := range pending {
+		r.launchOutput(o)
+	}
+}
+
+func (r *Recorder) launchOutput(o *sessionOutput) {
+	_, span := tracing.Start(o.traceCtx, "ffmpeg start")
+	// relays must be listening before the encoder starts sending
+	r.startRtmpRelays(o)
+	err := r.startFfmpeg(o)
+	tracing.End(span, err)
+	if err != nil {
+		o.logger.Errorln(err)
+		r.DetachOutput(o.req.Task, err)
+		return
+	}
+	r.Lock()
+	o.startedAt = time.Now().UTC()
+	r.Unlock()
+	r.reportState()
+
+	// so, if everything goes well then we can make callback
+	if r.OnAfterStartCallback != nil {
+		r.OnAfterStartCallback(o.req, r.outputVariant(o))
+	}
+}
+
+func (r *Recorder) afterOutputClosed(o *sessionOutput, err error) {
+	r.removeLocalHls(o)
+	clearProgress(o)
+	if r.OnAfterCloseCallback == nil {
+		return
+	}
+
+	variant := r.outputVariant(o)
+	r.Lock()
+	output := &Output{
+		FilePath:       o.filePath,
+		FileNames:      append([]string(nil), o.fileNames...),
+		FfmpegRestarts: o.ffmpegRestarts,
+		AudioOnly:      o.audioOnly,
+		StartedAt:      o.startedAt,
+
+		RecordingVariant: variant,
+	}
+	r.Unlock()
+	r.OnAfterCloseCallback(o.req, output, err)
+}
+
+func (r *Recorder) isJoined() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.joined
+}
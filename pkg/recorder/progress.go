@@ -0,0 +1,177 @@
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/metrics"
+)
+
+// FfmpegProgress is the latest progress reported by ffmpeg of an output
+type FfmpegProgress struct {
+	Frame       int64   `json:"frame"`
+	Fps         float64 `json:"fps"`
+	BitrateKbps float64 `json:"bitrate_kbps"`
+	TotalSize   int64   `json:"total_size"`
+	// in seconds
+	OutTime    float64 `json:"out_time"`
+	DupFrames  int64   `json:"dup_frames"`
+	DropFrames int64   `json:"drop_frames"`
+	// 1 is realtime
+	Speed     float64   `json:"speed"`
+	Stalled   bool      `json:"stalled"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// progressWriter parses the output of -progress pipe:1 of a single ffmpeg process
+type progressWriter struct {
+	r         *Recorder
+	o         *sessionOutput
+	ffmpegCmd *exec.Cmd
+	buf       []byte
+	current   FfmpegProgress
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.parseLine(string(bytes.TrimSpace(w.buf[:i])))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *progressWriter) parseLine(line string) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok || value == "N/A" {
+		return
+	}
+	switch key {
+	case "frame":
+		w.current.Frame, _ = strconv.ParseInt(value, 10, 64)
+	case "fps":
+		w.current.Fps, _ = strconv.ParseFloat(value, 64)
+	case "bitrate":
+		w.current.BitrateKbps, _ = strconv.ParseFloat(strings.TrimSuffix(value, "kbits/s"), 64)
+	case "total_size":
+		w.current.TotalSize, _ = strconv.ParseInt(value, 10, 64)
+	case "out_time_us":
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+			w.current.OutTime = float64(us) / 1000000
+		}
+	case "dup_frames":
+		w.current.DupFrames, _ = strconv.ParseInt(value, 10, 64)
+	case "drop_frames":
+		w.current.DropFrames, _ = strconv.ParseInt(value, 10, 64)
+	case "speed":
+		w.current.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+	case "progress":
+		// end of a block
+		w.r.updateProgress(w.o, w.ffmpegCmd, w.current)
+	}
+}
+
+func (r *Recorder) updateProgress(o *sessionOutput, ffmpegCmd *exec.Cmd, p FfmpegProgress) {
+	now := time.Now().UTC()
+	p.UpdatedAt = now
+
+	r.Lock()
+	if o.ffmpegCmd != ffmpegCmd {
+		// late report of a previous process
+		r.Unlock()
+		return
+	}
+	resumed := false
+	if o.progress == nil || p.OutTime > o.progress.OutTime {
+		o.outTimeAdvancedAt = now
+		resumed = o.stalled
+		o.stalled = false
+	}
+	p.Stalled = o.stalled
+	o.progress = &p
+	r.Unlock()
+
+	if resumed {
+		o.logger.Infoln(fmt.Sprintf("ffmpeg resumed for task: %s, roomTableId: %d, out time: %.1fs", o.req.Task.String(), o.req.GetRoomTableId(), p.OutTime))
+	}
+
+	id := progressMetricsId(o)
+	metrics.FfmpegFps.WithLabelValues(id).Set(p.Fps)
+	metrics.FfmpegSpeed.WithLabelValues(id).Set(p.Speed)
+	metrics.FfmpegBitrate.WithLabelValues(id).Set(p.BitrateKbps)
+	metrics.FfmpegDroppedFrames.WithLabelValues(id).Set(float64(p.DropFrames))
+	metrics.FfmpegDuplicatedFrames.WithLabelValues(id).Set(float64(p.DupFrames))
+}
+
+// watchFfmpegStall checks the progress of ffmpegCmd until done is closed
+func (r *Recorder) watchFfmpegStall(o *sessionOutput, ffmpegCmd *exec.Cmd, done <-chan struct{}) {
+	settings := r.AppCnf.Recorder.FfmpegStall
+	if *settings.Timeout == 0 {
+		// disabled
+		return
+	}
+	timeout := time.Duration(*settings.Timeout) * time.Second
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.Lock()
+		if o.ffmpegCmd != ffmpegCmd || o.stalled || time.Since(o.outTimeAdvancedAt) < timeout {
+			r.Unlock()
+			continue
+		}
+		o.stalled = true
+		outTime := 0.0
+		if o.progress != nil {
+			o.progress.Stalled = true
+			outTime = o.progress.OutTime
+		}
+		// killing is only useful if it will be restarted
+		restart := settings.Restart && o.ffmpegRestarts < r.AppCnf.Recorder.FfmpegRestart.MaxRestarts
+		r.Unlock()
+
+		metrics.FfmpegStalls.WithLabelValues(o.req.Task.String()).Inc()
+		o.logger.Warnln(fmt.Sprintf("ffmpeg stalled for task: %s, roomTableId: %d, out time: %.1fs didn't advance for %v, restart: %t", o.req.Task.String(), o.req.GetRoomTableId(), outTime, timeout, restart))
+		r.emitEvent(o.req, EventFfmpegStalled, map[string]string{
+			"out_time": fmt.Sprintf("%.1f", outTime),
+			"timeout":  fmt.Sprintf("%d", *settings.Timeout),
+			"restart":  strconv.FormatBool(restart),
+		})
+
+		if restart {
+			// superviseFfmpeg will restart it with a new part
+			_ = ffmpegCmd.Process.Kill()
+			return
+		}
+	}
+}
+
+// clearProgress removes the progress metrics of the output
+func clearProgress(o *sessionOutput) {
+	id := progressMetricsId(o)
+	metrics.FfmpegFps.DeleteLabelValues(id)
+	metrics.FfmpegSpeed.DeleteLabelValues(id)
+	metrics.FfmpegBitrate.DeleteLabelValues(id)
+	metrics.FfmpegDroppedFrames.DeleteLabelValues(id)
+	metrics.FfmpegDuplicatedFrames.DeleteLabelValues(id)
+}
+
+func progressMetricsId(o *sessionOutput) string {
+	return fmt.Sprintf("%d-%d", o.req.GetRoomTableId(), o.req.Task)
+}
@@ -0,0 +1,150 @@
+package recorder
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+func newProgressTest(timeout uint64, restart bool, maxRestarts int) (*Recorder, *sessionOutput) {
+	appCnf := new(config.AppConfig)
+	appCnf.Recorder.FfmpegStall.Timeout = &timeout
+	appCnf.Recorder.FfmpegStall.Restart = restart
+	appCnf.Recorder.FfmpegRestart.MaxRestarts = maxRestarts
+
+	req := &wemeet.WeMeetToRecorder{Task: wemeet.RecordingTasks_START_RECORDING, RoomTableId: 1}
+	r := &Recorder{AppCnf: appCnf, ctx: context.Background()}
+	o := &sessionOutput{req: req, logger: tasklog.Entry(req), ffmpegCmd: new(exec.Cmd), outTimeAdvancedAt: time.Now()}
+	return r, o
+}
+
+func (r *Recorder) progressOf(o *sessionOutput) *FfmpegProgress {
+	r.Lock()
+	defer r.Unlock()
+	if o.progress == nil {
+		return nil
+	}
+	p := *o.progress
+	return &p
+}
+
+func TestProgressWriter(t *testing.T) {
+	r, o := newProgressTest(30, false, 0)
+	w := &progressWriter{r: r, o: o, ffmpegCmd: o.ffmpegCmd}
+
+	// a block split in the middle of a line
+	_, _ = w.Write([]byte("frame=120\nfps=30.00\nbitrate=2048.5kbits/s\ntotal_size=1048576\nout_time_us=40"))
+	if r.progressOf(o) != nil {
+		t.Fatal("progress was reported before the end of the block")
+	}
+	_, _ = w.Write([]byte("00000\ndup_frames=2\ndrop_frames=1\nspeed=1.01x\nprogress=continue\n"))
+
+	p := r.progressOf(o)
+	if p == nil {
+		t.Fatal("progress wasn't reported at the end of the block")
+	}
+	if p.Frame != 120 || p.Fps != 30 || p.BitrateKbps != 2048.5 || p.TotalSize != 1048576 ||
+		p.OutTime != 4 || p.DupFrames != 2 || p.DropFrames != 1 || p.Speed != 1.01 {
+		t.Fatalf("unexpected progress: %+v", p)
+	}
+
+	// N/A keeps the previous values, the last block ends with progress=end
+	_, _ = w.Write([]byte("frame=150\nfps=N/A\nbitrate=N/A\nout_time_us=N/A\nspeed=N/A\nprogress=end\n"))
+	p = r.progressOf(o)
+	if p.Frame != 150 || p.Fps != 30 || p.BitrateKbps != 2048.5 || p.OutTime != 4 || p.Speed != 1.01 {
+		t.Fatalf("unexpected progress after N/A: %+v", p)
+	}
+
+	// a report of a previous process is ignored
+	o.ffmpegCmd = new(exec.Cmd)
+	_, _ = w.Write([]byte("frame=300\nprogress=continue\n"))
+	if p := r.progressOf(o); p.Frame != 150 {
+		t.Fatalf("report of a previous process was used: %+v", p)
+	}
+}
+
+func TestWatchFfmpegStall(t *testing.T) {
+	r, o := newProgressTest(1, false, 0)
+	events := make(chan map[string]string, 1)
+	r.OnEventCallback = func(req *wemeet.WeMeetToRecorder, event string, details map[string]string) {
+		if event == EventFfmpegStalled {
+			events <- details
+		}
+	}
+	o.progress = &FfmpegProgress{OutTime: 10}
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.watchFfmpegStall(o, o.ffmpegCmd, done)
+
+	select {
+	case details := <-events:
+		if details["out_time"] != "10.0" || details["restart"] != "false" {
+			t.Fatalf("unexpected details: %v", details)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stall wasn't detected")
+	}
+	if p := r.progressOf(o); !p.Stalled {
+		t.Fatal("progress wasn't marked as stalled")
+	}
+
+	// advance of the output time resumes it
+	r.updateProgress(o, o.ffmpegCmd, FfmpegProgress{OutTime: 11})
+	r.Lock()
+	stalled := o.stalled
+	r.Unlock()
+	if stalled {
+		t.Fatal("output is still stalled after the output time has advanced")
+	}
+}
+
+func TestWatchFfmpegStallRestart(t *testing.T) {
+	r, o := newProgressTest(1, true, 1)
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skip("sleep is not available:", err)
+	}
+	o.ffmpegCmd = cmd
+
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go r.watchFfmpegStall(o, cmd, done)
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatal("stalled process wasn't killed")
+	}
+}
+
+func TestWatchFfmpegStallDisabled(t *testing.T) {
+	r, o := newProgressTest(0, true, 1)
+	o.outTimeAdvancedAt = time.Now().Add(-time.Hour)
+
+	returned := make(chan struct{})
+	go func() {
+		r.watchFfmpegStall(o, o.ffmpegCmd, make(chan struct{}))
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("watcher is running with timeout 0")
+	}
+	if o.stalled {
+		t.Fatal("output was marked as stalled with timeout 0")
+	}
+}
@@ -0,0 +1,112 @@
+package recorder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"mvdan.cc/sh/v3/shell"
+)
+
+const (
+	hlsFileScheme = "file+hls://"
+	// localHlsScheme will be packaged under the work_dir of hls_server
+	// and served by it, e.g. hls://local
+	localHlsScheme = "hls://"
+)
+
+// LocalHlsDir returns the directory of the local hls playlist of a live task,
+// hls_server will serve it as /hls/{roomId}/{recordingId}/index.m3u8
+func LocalHlsDir(appCnf *config.AppConfig, roomId, recordingId string) string {
+	return path.Join(appCnf.HlsServer.WorkDir, roomId, recordingId)
+}
+
+// resolveLocalHls replaces hls:// destinations with the playlist path in the work_dir
+func (r *Recorder) resolveLocalHls(o *sessionOutput, destinations []string) ([]string, error) {
+	var resolved []string
+	for _, d := range destinations {
+		if !hasScheme(d, localHlsScheme) {
+			resolved = append(resolved, d)
+			continue
+		}
+		if !r.AppCnf.HlsServer.Enabled {
+			return nil, errors.New("local hls output requested but hls_server is disabled")
+		}
+		if !isSafePathElement(o.req.GetRoomId()) || !isSafePathElement(o.req.GetRecordingId()) {
+			return nil, errors.New("invalid roomId or recordingId for local hls output")
+		}
+
+		dir := LocalHlsDir(r.AppCnf, o.req.GetRoomId(), o.req.GetRecordingId())
+		r.Lock()
+		o.localHlsDir = dir
+		r.Unlock()
+		o.logger.Infoln(fmt.Sprintf("local hls output for task: %s, roomTableId: %d will be served as /hls/%s/%s/index.m3u8", o.req.Task.String(), o.req.GetRoomTableId(), o.req.GetRoomId(), o.req.GetRecordingId()))
+		resolved = append(resolved, hlsFileScheme+dir)
+	}
+	return resolved, nil
+}
+
+// removeLocalHls removes the playlist & segments, so nobody can watch it after the task
+func (r *Recorder) removeLocalHls(o *sessionOutput) {
+	r.Lock()
+	dir := o.localHlsDir
+	o.localHlsDir = ""
+	r.Unlock()
+	if dir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		o.logger.Errorln(fmt.Sprintf("failed to remove local hls dir %s, error: %s", dir, err.Error()))
+	}
+}
+
+// hasScheme reports whether destination starts with scheme, ignoring the case
+func hasScheme(destination, scheme string) bool {
+	return len(destination) >= len(scheme) && strings.EqualFold(destination[:len(scheme)], scheme)
+}
+
+func isSafePathElement(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
+
+// outputProtocolArgs selects the muxer & protocol options from the scheme of the destination.
+// It returns the args including the output itself.
+func outputProtocolArgs(settings *config.FfmpegSettings, destination string) ([]string, error) {
+	var options, target string
+	scheme, rest, _ := strings.Cut(destination, "://")
+
+	switch strings.ToLower(scheme) {
+	case "rtmp":
+		options, target = settings.Protocols.Rtmp, destination
+	case "rtmps":
+		options, target = settings.Protocols.Rtmps, destination
+	case "srt":
+		options, target = settings.Protocols.Srt, destination
+	case "file+hls":
+		options = settings.Protocols.Hls
+		// without the scheme as it was matched, in any case
+		target = rest
+		if target == "" {
+			return nil, errors.New("missing path of hls output")
+		}
+		if !strings.HasSuffix(target, ".m3u8") {
+			target = path.Join(target, "index.m3u8")
+		}
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported output protocol: %s", scheme)
+	}
+
+	args, err := shell.Fields(options, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ffmpeg %s protocol args: %w", scheme, err)
+	}
+
+	return append(args, target), nil
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
 	"os/exec"
 	"strings"
 )
@@ -18,7 +17,7 @@ func (r *Recorder) createPulseSink() error {
 		fmt.Sprintf("sink_name=\"%s\"", r.pulseSinkName),
 		fmt.Sprintf("sink_properties=device.description=\"%s\"", r.pulseSinkName),
 	}
-	log.Infoln(fmt.Sprintf("creating pulse sink for task: %s with agrs: %s", r.Req.Task, strings.Join(args, " ")))
+	r.logger.Infoln(fmt.Sprintf("creating pulse sink for task: %s with agrs: %s", r.Req.Task, strings.Join(args, " ")))
 
 	cmd := exec.CommandContext(r.ctx, "pactl", args...)
 	b, err := cmd.CombinedOutput()
@@ -28,7 +27,7 @@ func (r *Recorder) createPulseSink() error {
 
 	r.Lock()
 	r.pulseSinkId = strings.TrimSpace(string(b))
-	log.Infoln("pulse sink created successfully with id:", r.pulseSinkId)
+	r.logger.Infoln("pulse sink created successfully with id:", r.pulseSinkId)
 	r.Unlock()
 
 	return nil
@@ -39,11 +38,11 @@ func (r *Recorder) closePulse(ctx context.Context) {
 	defer r.Unlock()
 
 	if r.pulseSinkId != "" {
-		log.Infoln(fmt.Sprintf("unloading pulse module: %s for task: %s, roomTableId: %d", r.pulseSinkId, r.Req.Task.String(), r.Req.GetRoomTableId()))
+		r.logger.Infoln(fmt.Sprintf("unloading pulse module: %s for task: %s, roomTableId: %d", r.pulseSinkId, r.Req.Task.String(), r.Req.GetRoomTableId()))
 
 		cmd := exec.CommandContext(ctx, "pactl", "unload-module", r.pulseSinkId)
 		if _, err := cmd.CombinedOutput(); err != nil {
-			log.Errorln("failed to unload pulse sink", err)
+			r.logger.Errorln("failed to unload pulse sink", err)
 		}
 		r.pulseSinkId = ""
 	}
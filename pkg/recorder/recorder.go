@@ -3,13 +3,13 @@ package recorder
 import (
 	"context"
 	"fmt"
-	"os"
 	"os/exec"
-	"path"
 	"sync"
 	"time"
 
 	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tasklog"
+	"github.com/retawsolit/WeMeet-recorder/pkg/tracing"
 	"github.com/retawsolit/wemeet-protocol/wemeet"
 	log "github.com/sirupsen/logrus"
 )
@@ -19,15 +19,26 @@ const (
 	shutdownTimeout        = time.Second * 5
 )
 
+// Recorder is a browser session joined to a room. The captured display and
+// pulse sink can be written by more than one output, e.g. recording and rtmp.
 type Recorder struct {
 	joinUrl  string
-	filePath string
-	fileName string
+	debugDir string
 
-	Req                  *wemeet.WeMeetToRecorder
+	// Req is the task which has created this session
+	Req *wemeet.WeMeetToRecorder
+	// TraceCtx is the parent of the spans of Req, can be nil
+	TraceCtx             context.Context
 	AppCnf               *config.AppConfig
-	OnAfterStartCallback func(req *wemeet.WeMeetToRecorder)
-	OnAfterCloseCallback func(req *wemeet.WeMeetToRecorder, filePath, fileName string, err error)
+	OnAfterStartCallback func(req *wemeet.WeMeetToRecorder, variant wemeet.CloudRecordingVariants)
+	OnAfterCloseCallback func(req *wemeet.WeMeetToRecorder, output *Output, err error)
+	// OnDestinationStatusCallback will be called when the state of a fan-out destination changes,
+	// at most once every 30 seconds
+	OnDestinationStatusCallback func(req *wemeet.WeMeetToRecorder, statuses []DestinationStatus)
+	// OnStateChangeCallback will be called when processes or files of an output change
+	OnStateChangeCallback func(req *wemeet.WeMeetToRecorder, state *SessionState)
+	// OnEventCallback will be called for the internal events, e.g. EventJoinedRoom
+	OnEventCallback func(req *wemeet.WeMeetToRecorder, event string, details map[string]string)
 
 	ctx           context.Context
 	ctxCancel     context.CancelFunc
@@ -35,8 +46,19 @@ type Recorder struct {
 	pulseSinkName string
 	pulseSinkId   string
 	xvfbCmd       *exec.Cmd
-	ffmpegCmd     *exec.Cmd
 	closeChrome   context.CancelFunc
+	chromeCtx     context.Context
+	chromePid     int
+	outputs       map[wemeet.RecordingTasks]*sessionOutput
+
+	audioOnly        bool
+	variant          wemeet.CloudRecordingVariants
+	joined           bool
+	chromeGen        int
+	chromeRecoveries int
+	closed           bool
+	// tagged with the fields of Req
+	logger *log.Entry
 
 	sync.Mutex
 	closeOnce sync.Once
@@ -44,6 +66,13 @@ type Recorder struct {
 
 func New(r *Recorder) *Recorder {
 	r.ctx, r.ctxCancel = context.WithCancel(context.Background())
+	if r.TraceCtx == nil {
+		r.TraceCtx = context.Background()
+	}
+	r.logger = tasklog.Entry(r.Req)
+	r.outputs = map[wemeet.RecordingTasks]*sessionOutput{
+		r.Req.Task: {req: r.Req, traceCtx: r.TraceCtx, logger: r.logger},
+	}
 	return r
 }
 
@@ -51,31 +80,41 @@ func (r *Recorder) Start() error {
 	var err error
 	defer func() {
 		if err != nil {
-			log.Errorln(fmt.Sprintf("failed to start recorder for task: %s, roomTableId: %d, error: %v", r.Req.Task.String(), r.Req.GetRoomTableId(), err))
+			r.logger.Errorln(fmt.Sprintf("failed to start recorder for task: %s, roomTableId: %d, error: %v", r.Req.Task.String(), r.Req.GetRoomTableId(), err))
 			r.Close(err)
 		}
 	}()
 
-	if r.Req.Task == wemeet.RecordingTasks_START_RECORDING {
-		r.filePath = path.Join(r.AppCnf.Recorder.CopyToPath.MainPath, r.AppCnf.Recorder.CopyToPath.SubPath, r.Req.GetRoomId())
-		err = os.MkdirAll(r.filePath, 0755)
-		if err != nil {
-			return err
-		}
-		r.fileName = r.Req.GetRecordingId() + "_raw.mp4"
+	// without any video output, there is nothing to capture from the display
+	r.audioOnly = IsAudioOnly(r.AppCnf, r.Req)
+	// media only will be set after applying the layout
+	r.variant = wemeet.CloudRecordingVariants_FULL_SCREEN_CLOUD_RECORDING
+
+	o := r.outputs[r.Req.Task]
+	if err = r.prepareOutput(o); err != nil {
+		return err
 	}
+	r.debugDir = o.filePath
 
 	r.joinUrl = fmt.Sprintf("%s/?access_token=%s", r.AppCnf.WeMeetInfo.Host, r.Req.GetAccessToken())
 	if r.AppCnf.WeMeetInfo.JoinHost != nil && *r.AppCnf.WeMeetInfo.JoinHost != "" {
 		r.joinUrl = *r.AppCnf.WeMeetInfo.JoinHost + r.Req.GetAccessToken()
 	}
 
-	if err = r.createPulseSink(); err != nil {
+	_, span := tracing.Start(r.TraceCtx, "pulse create sink")
+	err = r.createPulseSink()
+	tracing.End(span, err)
+	if err != nil {
 		return err
 	}
-	if err = r.launchXvfb(); err != nil {
+	// chrome needs a display even if it won't be captured
+	_, span = tracing.Start(r.TraceCtx, "xvfb launch")
+	err = r.launchXvfb()
+	tracing.End(span, err)
+	if err != nil {
 		return err
 	}
+	r.reportState()
 
 	// start chrome in go routine and return response immediately
 	// otherwise user will see error message if wait too long
@@ -84,8 +123,21 @@ func (r *Recorder) Start() error {
 	return nil
 }
 
+// Close will stop the whole session and all of its outputs
 func (r *Recorder) Close(err error) {
 	r.closeOnce.Do(func() {
+		_, span := tracing.Start(r.TraceCtx, "recorder close")
+		defer tracing.End(span, err)
+
+		r.Lock()
+		r.closed = true
+		var outputs []*sessionOutput
+		for task, o := range r.outputs {
+			outputs = append(outputs, o)
+			delete(r.outputs, task)
+		}
+		r.Unlock()
+
 		// timeout for graceful shutdown
 		shutdownCtx, cancel := context.WithTimeout(r.ctx, shutdownTimeout)
 		defer cancel()
@@ -93,7 +145,9 @@ func (r *Recorder) Close(err error) {
 		done := make(chan struct{})
 		go func() {
 			defer close(done)
-			r.closeFfmpeg()
+			for _, o := range outputs {
+				r.closeFfmpeg(o)
+			}
 			r.closeChromeDp()
 			r.closeXvfb()
 			r.closePulse(shutdownCtx)
@@ -101,13 +155,13 @@ func (r *Recorder) Close(err error) {
 
 		select {
 		case <-done:
-			log.Infoln("graceful shutdown finished for task:", r.Req.Task.String())
+			r.logger.Infoln("graceful shutdown finished for task:", r.Req.Task.String())
 		case <-shutdownCtx.Done():
-			log.Errorln("graceful shutdown timed out for task:", r.Req.Task.String(), "forcing close")
+			r.logger.Errorln("graceful shutdown timed out for task:", r.Req.Task.String(), "forcing close")
 		}
 
-		if r.OnAfterCloseCallback != nil {
-			r.OnAfterCloseCallback(r.Req, r.filePath, r.fileName, err)
+		for _, o := range outputs {
+			r.afterOutputClosed(o, err)
 		}
 
 		// close everything if still running
@@ -116,10 +170,11 @@ func (r *Recorder) Close(err error) {
 }
 
 type infoLogger struct {
-	cmd string
+	cmd    string
+	logger *log.Entry
 }
 
 func (l *infoLogger) Write(p []byte) (int, error) {
-	log.Infoln(fmt.Sprintf("%s: %s", l.cmd, string(p)))
+	l.logger.Infoln(fmt.Sprintf("%s: %s", l.cmd, string(p)))
 	return len(p), nil
 }
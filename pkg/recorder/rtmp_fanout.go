@@ -0,0 +1,382 @@
+package recorder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+// destinationReportInterval is the min time between two reports of the destinations of an output
+const destinationReportInterval = 30 * time.Second
+
+var errNoDestinationLeft = errors.New("all the rtmp destinations have failed")
+
+// DestinationStatus is the state of a single rtmp destination during fan-out
+type DestinationStatus struct {
+	// Destination is the url without stream key, so it's safe to log or send
+	Destination string
+	Running     bool
+	// Failed is true once the destination has used all of its retries
+	Failed    bool
+	Retries   int
+	LastError string
+}
+
+// rtmpRelay pushes the stream encoded once by the main ffmpeg process
+// to a single destination, so that a failing destination doesn't affect others
+type rtmpRelay struct {
+	destination string
+	// the encoder sends to this socket, it's kept open for the whole
+	// output, so no other process can take the port between two relays
+	conn    net.PacketConn
+	port    int
+	cmd     *exec.Cmd
+	running bool
+	failed  bool
+	retries int
+	lastErr string
+
+	// stdin of the running ffmpeg
+	stdinMu sync.Mutex
+	stdin   io.WriteCloser
+}
+
+// RtmpDestinations returns all the destinations of the rtmp task.
+// rtmp_url of the request can contain multiple urls separated by comma
+// and room_overrides can add more for the room.
+func RtmpDestinations(appCnf *config.AppConfig, req *wemeet.WeMeetToRecorder) []string {
+	var list []string
+	seen := make(map[string]bool)
+	add := func(u string) {
+		u = strings.TrimSpace(u)
+		if u != "" && !seen[u] {
+			seen[u] = true
+			list = append(list, u)
+		}
+	}
+
+	for _, u := range strings.Split(req.GetRtmpUrl(), ",") {
+		add(u)
+	}
+	if o, ok := appCnf.Recorder.RoomOverrides[req.GetRoomId()]; ok {
+		for _, u := range o.RtmpDestinations {
+			add(u)
+		}
+	}
+
+	return list
+}
+
+// maskDestination removes the stream key from the url
+func maskDestination(destination string) string {
+	if hasScheme(destination, hlsFileScheme) {
+		// local path, nothing to hide
+		return destination
+	}
+	u, err := url.Parse(destination)
+	if err != nil || u.Host == "" {
+		return "invalid url"
+	}
+	if u.Path == "" {
+		return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+	}
+	return fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, path.Dir(u.Path))
+}
+
+// relayMatch returns a part of the cmdline of the relay which is safe to persist
+func relayMatch(destination string) string {
+	if hasScheme(destination, hlsFileScheme) {
+		return destination[len(hlsFileScheme):]
+	}
+	u, err := url.Parse(destination)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func (r *Recorder) prepareRtmpRelays(o *sessionOutput) error {
+	destinations := RtmpDestinations(r.AppCnf, o.req)
+	if len(destinations) == 0 {
+		return errors.New("no rtmp destination found")
+	}
+	destinations, err := r.resolveLocalHls(o, destinations)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	o.destinations = destinations
+	r.Unlock()
+	if len(destinations) == 1 {
+		// ffmpeg will push directly
+		return nil
+	}
+
+	var relays []*rtmpRelay
+	for _, d := range destinations {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			for _, relay := range relays {
+				_ = relay.conn.Close()
+			}
+			return err
+		}
+		relays = append(relays, &rtmpRelay{destination: d, conn: conn, port: conn.LocalAddr().(*net.UDPAddr).Port})
+	}
+
+	r.Lock()
+	o.relays = relays
+	o.reportedDestinations = destinationsSignature(relays)
+	r.Unlock()
+	return nil
+}
+
+// teeOutputArgs will make the encoder send the streams selected by maps to every relay
+func (r *Recorder) teeOutputArgs(o *sessionOutput, maps []string) []string {
+	var outputs []string
+	for _, relay := range o.relays {
+		outputs = append(outputs, fmt.Sprintf("[f=mpegts]udp://127.0.0.1:%d?pkt_size=1316", relay.port))
+	}
+
+	var args []string
+	for _, m := range maps {
+		args = append(args, "-map", m)
+	}
+	return append(args, "-f", "tee", strings.Join(outputs, "|"))
+}
+
+func (r *Recorder) startRtmpRelays(o *sessionOutput) {
+	for _, relay := range o.relays {
+		go relay.pump()
+		go r.runRtmpRelay(o, relay)
+	}
+}
+
+// pump passes the packets of the encoder to the running ffmpeg of the relay
+// until the socket is closed, packets are dropped while the relay is down
+func (relay *rtmpRelay) pump() {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := relay.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		relay.stdinMu.Lock()
+		stdin := relay.stdin
+		relay.stdinMu.Unlock()
+		if stdin != nil {
+			// fails only if ffmpeg has exited, it will be restarted with a new pipe
+			_, _ = stdin.Write(buf[:n])
+		}
+	}
+}
+
+func (relay *rtmpRelay) setStdin(stdin io.WriteCloser) {
+	relay.stdinMu.Lock()
+	old := relay.stdin
+	relay.stdin = stdin
+	relay.stdinMu.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+}
+
+// runRtmpRelay keeps pushing to the destination until the output is stopped,
+// retrying with backoff whenever the destination fails up to max_destination_retries
+func (r *Recorder) runRtmpRelay(o *sessionOutput, relay *rtmpRelay) {
+	args := []string{
+		"-loglevel", "error",
+		"-f", "mpegts",
+		"-i", "pipe:0",
+		"-c", "copy",
+	}
+	outputArgs, err := outputProtocolArgs(r.AppCnf.FfmpegSettings, relay.destination)
+	if err != nil {
+		o.logger.Errorln(fmt.Sprintf("destination %s can't be used for task: %s, roomTableId: %d, error: %s", maskDestination(relay.destination), o.req.Task.String(), o.req.GetRoomTableId(), err.Error()))
+		r.Lock()
+		relay.failed = true
+		relay.lastErr = err.Error()
+		r.Unlock()
+		r.onRelayFailed(o)
+		return
+	}
+	args = append(args, outputArgs...)
+	settings := r.AppCnf.Recorder.FfmpegRestart
+	// -1 is unlimited
+	maxRetries := *r.AppCnf.Recorder.MaxDestinationRetries
+	maxBackoff := time.Duration(settings.MaxBackoff) * time.Second
+
+	for {
+		r.Lock()
+		if r.closed || o.stopped {
+			r.Unlock()
+			return
+		}
+		cmd := exec.CommandContext(r.ctx, "ffmpeg", args...)
+		cmd.Stderr = &infoLogger{cmd: "ffmpeg-relay", logger: o.logger}
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err == nil {
+			relay.cmd = cmd
+			relay.running = true
+			relay.setStdin(stdin)
+		}
+		r.Unlock()
+
+		startedAt := time.Now()
+		if err == nil {
+			o.logger.Infoln(fmt.Sprintf("pushing to %s for task: %s, roomTableId: %d", maskDestination(relay.destination), o.req.Task.String(), o.req.GetRoomTableId()))
+			r.reportState()
+			r.reportDestinations(o)
+			err = cmd.Wait()
+			relay.setStdin(nil)
+		}
+
+		r.Lock()
+		relay.running = false
+		relay.cmd = nil
+		stopped := r.closed || o.stopped
+		if !stopped {
+			if time.Since(startedAt) > maxBackoff {
+				// it was working, so only the consecutive failures are counted
+				relay.retries = 0
+			}
+			relay.retries++
+			if err != nil {
+				relay.lastErr = err.Error()
+			}
+			relay.failed = maxRetries >= 0 && relay.retries > maxRetries
+		}
+		retries, failed := relay.retries, relay.failed
+		r.Unlock()
+		if stopped {
+			return
+		}
+		if failed {
+			o.logger.Errorln(fmt.Sprintf("destination %s failed for task: %s, roomTableId: %d, giving up after %d retries", maskDestination(relay.destination), o.req.Task.String(), o.req.GetRoomTableId(), maxRetries))
+			r.onRelayFailed(o)
+			return
+		}
+
+		backoff := utils.Backoff(retries, time.Duration(settings.Backoff)*time.Second, maxBackoff)
+		o.logger.Warnln(fmt.Sprintf("destination %s failed for task: %s, roomTableId: %d, retrying in %v", maskDestination(relay.destination), o.req.Task.String(), o.req.GetRoomTableId(), backoff))
+		r.reportDestinations(o)
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// onRelayFailed reports the failed destination,
+// the output will be closed with an error if none of its destinations is left
+func (r *Recorder) onRelayFailed(o *sessionOutput) {
+	r.Lock()
+	left := false
+	for _, relay := range o.relays {
+		if !relay.failed {
+			left = true
+			break
+		}
+	}
+	r.Unlock()
+
+	if left {
+		r.reportDestinations(o)
+		return
+	}
+	// the end of the task will be notified as failed
+	o.logger.Errorln(fmt.Sprintf("closing task: %s, roomTableId: %d, reason: %s", o.req.Task.String(), o.req.GetRoomTableId(), errNoDestinationLeft.Error()))
+	r.DetachOutput(o.req.Task, errNoDestinationLeft)
+}
+
+func (r *Recorder) closeRtmpRelays(o *sessionOutput) {
+	for _, relay := range o.relays {
+		_ = relay.conn.Close()
+		if relay.cmd != nil {
+			if err := relay.cmd.Process.Signal(os.Interrupt); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				_ = relay.cmd.Process.Kill()
+			}
+			relay.cmd = nil
+		}
+	}
+}
+
+// reportDestinations calls OnDestinationStatusCallback if the state of a destination has changed,
+// at most once in destinationReportInterval, later changes will be reported after the interval
+func (r *Recorder) reportDestinations(o *sessionOutput) {
+	if r.OnDestinationStatusCallback == nil {
+		return
+	}
+
+	r.Lock()
+	signature := destinationsSignature(o.relays)
+	if r.closed || o.stopped || signature == o.reportedDestinations {
+		r.Unlock()
+		return
+	}
+	if wait := destinationReportInterval - time.Since(o.destinationsReportedAt); wait > 0 {
+		if !o.destinationsReportPending {
+			o.destinationsReportPending = true
+			time.AfterFunc(wait, func() {
+				r.Lock()
+				o.destinationsReportPending = false
+				r.Unlock()
+				r.reportDestinations(o)
+			})
+		}
+		r.Unlock()
+		return
+	}
+	o.reportedDestinations = signature
+	o.destinationsReportedAt = time.Now()
+
+	var statuses []DestinationStatus
+	for _, relay := range o.relays {
+		statuses = append(statuses, DestinationStatus{
+			Destination: maskDestination(relay.destination),
+			Running:     relay.running,
+			Failed:      relay.failed,
+			Retries:     relay.retries,
+			LastError:   relay.lastErr,
+		})
+	}
+	r.Unlock()
+
+	r.OnDestinationStatusCallback(o.req, statuses)
+}
+
+// destinationsSignature represents the states of the relays, it must be called with the lock
+func destinationsSignature(relays []*rtmpRelay) string {
+	states := make([]string, 0, len(relays))
+	for _, relay := range relays {
+		switch {
+		case relay.failed:
+			states = append(states, "failed")
+		case relay.running || relay.retries == 0:
+			// not started yet is expected to be running
+			states = append(states, "running")
+		default:
+			states = append(states, "retrying")
+		}
+	}
+	return strings.Join(states, ",")
+}
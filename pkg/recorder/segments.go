@@ -0,0 +1,153 @@
+package recorder
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+// SegmentListSuffix is used as recording file name in segmented mode.
+// ffmpeg will append the name of every completed segment to this file.
+const SegmentListSuffix = "_segments.txt"
+
+// IsSegmentList will return true if fileName is the list of a segmented recording
+func IsSegmentList(fileName string) bool {
+	return strings.HasSuffix(fileName, SegmentListSuffix)
+}
+
+// ListSegments returns the segment files of recordingId found in filePath in recording order
+func ListSegments(filePath, recordingId string) ([]string, error) {
+	matches, err := filepath.Glob(path.Join(filePath, recordingId+"_raw_*.ts"))
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, m := range matches {
+		segments = append(segments, path.Base(m))
+	}
+	sortSegments(segments)
+
+	return segments, nil
+}
+
+// sortSegments sorts segments in recording order. Names are zero padded,
+// but the number can have more digits than the padding in a long recording.
+func sortSegments(segments []string) {
+	sort.SliceStable(segments, func(i, j int) bool {
+		ni, nj := segmentNumber(segments[i]), segmentNumber(segments[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return segments[i] < segments[j]
+	})
+}
+
+// segmentNumber returns the number of the segment file, -1 if it has none
+func segmentNumber(segment string) int {
+	name := strings.TrimSuffix(segment, ".ts")
+	n, err := strconv.Atoi(name[strings.LastIndex(name, "_")+1:])
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// ReadSegmentLists returns the completed segments written by every ffmpeg process
+// of recordingId in their list files, in recording order
+func ReadSegmentLists(filePath, recordingId string) ([]string, error) {
+	lists, err := filepath.Glob(path.Join(filePath, recordingId+"_part*"+SegmentListSuffix))
+	if err != nil {
+		return nil, err
+	}
+	// the first process is using the list without part
+	lists = append([]string{path.Join(filePath, recordingId+SegmentListSuffix)}, lists...)
+
+	var segments []string
+	found := false
+	for _, l := range lists {
+		listed, err := ReadSegmentList(filePath, path.Base(l))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		found = true
+		segments = append(segments, listed...)
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	sortSegments(segments)
+
+	return segments, nil
+}
+
+// SegmentListFiles returns the list files of recordingId found in filePath
+func SegmentListFiles(filePath, recordingId string) []string {
+	lists, _ := filepath.Glob(path.Join(filePath, recordingId+"_part*"+SegmentListSuffix))
+	files := []string{recordingId + SegmentListSuffix}
+	for _, l := range lists {
+		files = append(files, path.Base(l))
+	}
+	return files
+}
+
+// ReadSegmentList returns the completed segments written in the list file by ffmpeg
+func ReadSegmentList(filePath, listFileName string) ([]string, error) {
+	f, err := os.Open(path.Join(filePath, listFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var segments []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if l := strings.TrimSpace(scanner.Text()); l != "" {
+			segments = append(segments, path.Base(l))
+		}
+	}
+
+	return segments, scanner.Err()
+}
+
+// segmentOutputArgs returns the output of the segment muxer, attempt is the number of
+// restarts of ffmpeg. Every process gets its own list file, because ffmpeg truncates it.
+func (r *Recorder) segmentOutputArgs(req *wemeet.WeMeetToRecorder, filePath, listFileName string, attempt int) ([]string, error) {
+	pattern := req.GetRecordingId() + "_raw_%05d.ts"
+
+	// after a restart of ffmpeg we'll continue after the highest number,
+	// so that an existing segment will never be overwritten
+	existing, err := ListSegments(filePath, req.GetRecordingId())
+	if err != nil {
+		return nil, err
+	}
+	startNumber := 0
+	for _, s := range existing {
+		if n := segmentNumber(s); n >= startNumber {
+			startNumber = n + 1
+		}
+	}
+	if attempt > 0 {
+		listFileName = fmt.Sprintf("%s_part%d%s", req.GetRecordingId(), attempt, SegmentListSuffix)
+	}
+
+	return []string{
+		"-f", "segment",
+		"-segment_time", fmt.Sprintf("%d", r.AppCnf.Recorder.SegmentedRecording.SegmentDuration),
+		"-segment_format", "mpegts",
+		"-segment_start_number", fmt.Sprintf("%d", startNumber),
+		"-reset_timestamps", "1",
+		"-segment_list", path.Join(filePath, listFileName),
+		"-segment_list_type", "flat",
+		path.Join(filePath, pattern),
+	}, nil
+}
@@ -0,0 +1,135 @@
+package recorder
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListSegments(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{
+			name:  "single process",
+			files: []string{"rec_raw_00002.ts", "rec_raw_00000.ts", "rec_raw_00001.ts"},
+			want:  []string{"rec_raw_00000.ts", "rec_raw_00001.ts", "rec_raw_00002.ts"},
+		},
+		{
+			name:  "more digits than the padding",
+			files: []string{"rec_raw_100000.ts", "rec_raw_99999.ts", "rec_raw_100001.ts"},
+			want:  []string{"rec_raw_99999.ts", "rec_raw_100000.ts", "rec_raw_100001.ts"},
+		},
+		{
+			name: "other files are ignored",
+			files: []string{"rec_raw_00001.ts", "rec_raw_00000.ts", "rec_segments.txt", "rec_part1_segments.txt",
+				"rec_raw.mp4", "rec_raw_part1.mp4", "other_raw_00000.ts"},
+			want: []string{"rec_raw_00000.ts", "rec_raw_00001.ts"},
+		},
+		{
+			name:  "no segment",
+			files: []string{"rec_segments.txt"},
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := make(map[string]string)
+			for _, f := range tt.files {
+				files[f] = ""
+			}
+			writeFiles(t, dir, files)
+
+			got, err := ListSegments(dir, "rec")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSegmentLists(t *testing.T) {
+	tests := []struct {
+		name    string
+		lists   map[string]string
+		want    []string
+		wantErr error
+	}{
+		{
+			name: "lists of every process in recording order",
+			lists: map[string]string{
+				"rec" + SegmentListSuffix:         "rec_raw_00000.ts\nrec_raw_00001.ts\n",
+				"rec_part2" + SegmentListSuffix:   "rec_raw_00005.ts\n",
+				"rec_part1" + SegmentListSuffix:   "/recordings/room/rec_raw_00002.ts\n\nrec_raw_00003.ts\n",
+				"other_part1" + SegmentListSuffix: "other_raw_00004.ts\n",
+			},
+			want: []string{"rec_raw_00000.ts", "rec_raw_00001.ts", "rec_raw_00002.ts", "rec_raw_00003.ts", "rec_raw_00005.ts"},
+		},
+		{
+			name: "first process died before its first segment",
+			lists: map[string]string{
+				"rec_part1" + SegmentListSuffix: "rec_raw_00000.ts\n",
+			},
+			want: []string{"rec_raw_00000.ts"},
+		},
+		{
+			name:    "no list",
+			lists:   map[string]string{},
+			wantErr: os.ErrNotExist,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tt.lists)
+
+			got, err := ReadSegmentLists(dir, "rec")
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSegmentOutputArgsContinueAfterHighest(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"rec_raw_00000.ts": "", "rec_raw_00007.ts": "", "rec_raw_00003.ts": ""})
+
+	r := &Recorder{AppCnf: new(config.AppConfig)}
+	args, err := r.segmentOutputArgs(&wemeet.WeMeetToRecorder{RecordingId: "rec"}, dir, "rec"+SegmentListSuffix, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined := strings.Join(args, " ")
+	if !strings.Contains(joined, "-segment_start_number 8") {
+		t.Fatalf("segments must continue after the highest number: %s", joined)
+	}
+	if !strings.Contains(joined, path.Join(dir, "rec_part2"+SegmentListSuffix)) {
+		t.Fatalf("restarted process must use its own list: %s", joined)
+	}
+}
@@ -0,0 +1,146 @@
+package recorder
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+// ProcessInfo is a child process of the session
+type ProcessInfo struct {
+	Name string
+	Pid  int
+	// a part of the cmdline, to recognise the process later
+	Match string
+}
+
+// SessionState is the current state of an output, it will be reported
+// whenever processes or files of the output change
+type SessionState struct {
+	FilePath         string
+	FileNames        []string
+	AudioOnly        bool
+	RecordingVariant wemeet.CloudRecordingVariants
+	Processes        []ProcessInfo
+	PulseSinkId      string
+	PulseSinkName    string
+}
+
+// reportState calls OnStateChangeCallback for every output of the session
+func (r *Recorder) reportState() {
+	if r.OnStateChangeCallback == nil {
+		return
+	}
+
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return
+	}
+	outputs := make([]*sessionOutput, 0, len(r.outputs))
+	for _, o := range r.outputs {
+		outputs = append(outputs, o)
+	}
+	r.Unlock()
+
+	for _, o := range outputs {
+		r.OnStateChangeCallback(o.req, r.outputState(o))
+	}
+}
+
+func (r *Recorder) outputState(o *sessionOutput) *SessionState {
+	variant := r.outputVariant(o)
+
+	r.Lock()
+	defer r.Unlock()
+	state := &SessionState{
+		FilePath:         o.filePath,
+		FileNames:        append([]string(nil), o.fileNames...),
+		AudioOnly:        o.audioOnly,
+		RecordingVariant: variant,
+		PulseSinkId:      r.pulseSinkId,
+		PulseSinkName:    r.pulseSinkName,
+	}
+
+	addProcess := func(name string, cmd *exec.Cmd, match string) {
+		if cmd != nil && cmd.Process != nil {
+			state.Processes = append(state.Processes, ProcessInfo{Name: name, Pid: cmd.Process.Pid, Match: match})
+		}
+	}
+	// shared by all the outputs of the session
+	addProcess("Xvfb", r.xvfbCmd, r.displayId)
+	if r.chromePid > 0 {
+		// chrome or chromium
+		state.Processes = append(state.Processes, ProcessInfo{Name: "chrom", Pid: r.chromePid, Match: fmt.Sprintf("--display=%s", r.displayId)})
+	}
+	addProcess("ffmpeg", o.ffmpegCmd, fmt.Sprintf("%s.monitor", r.pulseSinkName))
+	for _, relay := range o.relays {
+		addProcess("ffmpeg", relay.cmd, relayMatch(relay.destination))
+	}
+
+	return state
+}
+
+// OutputInfo is a snapshot of an output, for status reporting
+type OutputInfo struct {
+	Req *wemeet.WeMeetToRecorder
+	// zero until ffmpeg was started
+	StartedAt      time.Time
+	FilePath       string
+	FileNames      []string
+	Bytes          int64
+	FfmpegRestarts int
+	AudioOnly      bool
+	// nil until ffmpeg has reported
+	Progress *FfmpegProgress
+}
+
+// HasOutput returns true if req is still an output of the session
+func (r *Recorder) HasOutput(req *wemeet.WeMeetToRecorder) bool {
+	r.Lock()
+	defer r.Unlock()
+	o, ok := r.outputs[req.Task]
+	return ok && o.req == req
+}
+
+// OutputInfo returns the snapshot of the output of task
+func (r *Recorder) OutputInfo(task wemeet.RecordingTasks) (*OutputInfo, bool) {
+	r.Lock()
+	o, ok := r.outputs[task]
+	if !ok {
+		r.Unlock()
+		return nil, false
+	}
+	info := &OutputInfo{
+		Req:            o.req,
+		StartedAt:      o.startedAt,
+		FilePath:       o.filePath,
+		FileNames:      append([]string(nil), o.fileNames...),
+		FfmpegRestarts: o.ffmpegRestarts,
+		AudioOnly:      o.audioOnly,
+	}
+	if o.progress != nil {
+		p := *o.progress
+		info.Progress = &p
+	}
+	r.Unlock()
+
+	// stat outside the lock
+	for _, f := range info.FileNames {
+		files := []string{f}
+		if IsSegmentList(f) {
+			files, _ = ListSegments(info.FilePath, info.Req.GetRecordingId())
+		}
+		for _, ff := range files {
+			if st, err := os.Stat(path.Join(info.FilePath, ff)); err == nil {
+				info.Bytes += st.Size()
+			}
+		}
+	}
+
+	return info, true
+}
@@ -0,0 +1,96 @@
+package recorder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/chromedp/chromedp"
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+)
+
+const mediaOnlyStyleId = "recorder-media-only"
+
+// RequestedVariant returns the recording variant configured for the room of req.
+// The setting of room_overrides has priority over recording_variant.
+func RequestedVariant(appCnf *config.AppConfig, req *wemeet.WeMeetToRecorder) wemeet.CloudRecordingVariants {
+	variant := appCnf.Recorder.RecordingVariant
+	if o, ok := appCnf.Recorder.RoomOverrides[req.GetRoomId()]; ok && o.RecordingVariant != nil {
+		variant = *o.RecordingVariant
+	}
+
+	if strings.ToLower(variant) == "media_only" {
+		return wemeet.CloudRecordingVariants_MEDIA_ONLY_CLOUD_RECORDING
+	}
+	return wemeet.CloudRecordingVariants_FULL_SCREEN_CLOUD_RECORDING
+}
+
+// RecordingVariant returns the variant this session is actually producing,
+// it can be different from the requested one if the layout couldn't be applied
+func (r *Recorder) RecordingVariant() wemeet.CloudRecordingVariants {
+	r.Lock()
+	defer r.Unlock()
+	return r.variant
+}
+
+// applyRecordingVariant will hide the UI of the client for media_only variant.
+// If that fails, we'll continue with full screen instead of ending the session.
+func (r *Recorder) applyRecordingVariant() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if r.AudioOnly() || RequestedVariant(r.AppCnf, r.Req) != wemeet.CloudRecordingVariants_MEDIA_ONLY_CLOUD_RECORDING {
+			return nil
+		}
+
+		variant := wemeet.CloudRecordingVariants_MEDIA_ONLY_CLOUD_RECORDING
+		if err := injectMediaOnlyCss(ctx, r.AppCnf.Recorder.MediaOnlyCss); err != nil {
+			r.logger.Errorln(fmt.Sprintf("failed to apply media only layout for task: %s, roomTableId: %d, falling back to full screen, error: %s", r.Req.Task.String(), r.Req.GetRoomTableId(), err.Error()))
+			variant = wemeet.CloudRecordingVariants_FULL_SCREEN_CLOUD_RECORDING
+		}
+
+		r.Lock()
+		r.variant = variant
+		r.Unlock()
+		return nil
+	})
+}
+
+// outputVariant returns the variant of the files written by the output,
+// audio only recordings are always media only
+func (r *Recorder) outputVariant(o *sessionOutput) wemeet.CloudRecordingVariants {
+	r.Lock()
+	defer r.Unlock()
+	if o.audioOnly {
+		return wemeet.CloudRecordingVariants_MEDIA_ONLY_CLOUD_RECORDING
+	}
+	return r.variant
+}
+
+func injectMediaOnlyCss(ctx context.Context, css string) error {
+	cssJson, err := json.Marshal(css)
+	if err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf(`(() => {
+	let s = document.getElementById(%q);
+	if (!s) {
+		s = document.createElement('style');
+		s.id = %q;
+		document.head.appendChild(s);
+	}
+	s.textContent = %s;
+	return !!document.getElementById(%q);
+})()`, mediaOnlyStyleId, mediaOnlyStyleId, cssJson, mediaOnlyStyleId)
+
+	var applied bool
+	if err := chromedp.Evaluate(script, &applied).Do(ctx); err != nil {
+		return err
+	}
+	if !applied {
+		return errors.New("style was not added to the page")
+	}
+	return nil
+}
@@ -3,30 +3,31 @@ package recorder
 import (
 	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
+	"github.com/retawsolit/WeMeet-recorder/pkg/metrics"
 	"os"
 	"os/exec"
 	"strings"
 )
 
-// creates a new xvfb display
+// creates a new xvfb display, audio only sessions get a minimal one
 func (r *Recorder) launchXvfb() error {
 	r.displayId = fmt.Sprintf(":%d%d", r.Req.RoomTableId, r.Req.Task)
+	width, height := r.windowSize()
 
 	args := []string{
 		r.displayId,
 		"-nocursor",
-		"-screen", "0", fmt.Sprintf("%dx%dx24", r.AppCnf.Recorder.Width, r.AppCnf.Recorder.Height),
+		"-screen", "0", fmt.Sprintf("%dx%dx24", width, height),
 		"-ac",
 		"-nolisten", "tcp",
 		"-nolisten", "unix",
 		"-dpi", fmt.Sprintf("%d", r.AppCnf.Recorder.XvfbDpi),
 		"+extension", "RANDR",
 	}
-	log.Infoln(fmt.Sprintf("creating X dispaly for task: %s with agrs: %s", r.Req.Task, strings.Join(args, " ")))
+	r.logger.Infoln(fmt.Sprintf("creating X dispaly for task: %s with agrs: %s", r.Req.Task, strings.Join(args, " ")))
 
 	xvfb := exec.CommandContext(r.ctx, "Xvfb", args...)
-	xvfb.Stderr = &infoLogger{cmd: "xvfb"}
+	xvfb.Stderr = &infoLogger{cmd: "xvfb", logger: r.logger}
 	if err := xvfb.Start(); err != nil {
 		return errors.New("xvfb: " + err.Error())
 	}
@@ -39,7 +40,13 @@ func (r *Recorder) launchXvfb() error {
 		if err != nil {
 			var exitErr *exec.ExitError
 			if errors.As(err, &exitErr) {
-				log.Errorln(fmt.Errorf("xvfb exited with code: %d for task: %s, roomTableId: %d", exitErr.ExitCode(), r.Req.Task.String(), r.Req.GetRoomTableId()))
+				r.Lock()
+				closed := r.closed
+				r.Unlock()
+				if !closed {
+					metrics.ProcessExits.WithLabelValues("xvfb", fmt.Sprintf("%d", exitErr.ExitCode())).Inc()
+				}
+				r.logger.Errorln(fmt.Errorf("xvfb exited with code: %d for task: %s, roomTableId: %d", exitErr.ExitCode(), r.Req.Task.String(), r.Req.GetRoomTableId()))
 			}
 			r.Close(err)
 		}
@@ -52,10 +59,10 @@ func (r *Recorder) closeXvfb() {
 	defer r.Unlock()
 
 	if r.xvfbCmd != nil {
-		log.Infoln(fmt.Sprintf("closing X display for task: %s, roomTableId: %d", r.Req.Task.String(), r.Req.GetRoomTableId()))
+		r.logger.Infoln(fmt.Sprintf("closing X display for task: %s, roomTableId: %d", r.Req.Task.String(), r.Req.GetRoomTableId()))
 
 		if err := r.xvfbCmd.Process.Signal(os.Interrupt); err != nil && !errors.Is(err, os.ErrProcessDone) {
-			log.Errorln("failed to interrupt X display:", err.Error(), "so, trying to kill")
+			r.logger.Errorln("failed to interrupt X display:", err.Error(), "so, trying to kill")
 			_ = r.xvfbCmd.Process.Kill()
 		}
 		r.xvfbCmd = nil
@@ -0,0 +1,139 @@
+package hlsservice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/wemeet-protocol/auth"
+	log "github.com/sirupsen/logrus"
+)
+
+// HlsService serves the local hls live outputs written under work_dir.
+// Every request must have a valid WeMeet access token of the same room,
+// either as token query param or as Authorization: Bearer header.
+//
+// Playlist: /hls/{roomId}/{recordingId}/index.m3u8?token=
+type HlsService struct {
+	app    *config.AppConfig
+	server *http.Server
+}
+
+func New(app *config.AppConfig) *HlsService {
+	if app == nil {
+		app = config.GetConfig()
+	}
+	s := &HlsService{
+		app: app,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /hls/{roomId}/{recordingId}/{file}", s.handleFile)
+	s.server = &http.Server{
+		Addr:              app.HlsServer.ListenAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+// Run will block until the server was closed
+func (s *HlsService) Run() error {
+	if err := os.MkdirAll(s.app.HlsServer.WorkDir, 0755); err != nil {
+		return err
+	}
+	log.Infoln(fmt.Sprintf("hls server listening on %s, work_dir: %s", s.app.HlsServer.ListenAddress, s.app.HlsServer.WorkDir))
+
+	err := s.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *HlsService) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Errorln(err)
+	}
+}
+
+func (s *HlsService) handleFile(w http.ResponseWriter, r *http.Request) {
+	roomId, recordingId, file := r.PathValue("roomId"), r.PathValue("recordingId"), r.PathValue("file")
+	for _, p := range []string{roomId, recordingId, file} {
+		if p == "" || p == "." || p == ".." || strings.ContainsAny(p, `/\`) {
+			http.Error(w, "invalid path", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if token == "" {
+		http.Error(w, "token required", http.StatusUnauthorized)
+		return
+	}
+	claims, err := auth.VerifyWeMeetAccessToken(s.app.WeMeetInfo.ApiKey, s.app.WeMeetInfo.ApiSecret, token, true)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	if claims.RoomId != roomId {
+		http.Error(w, "token is not valid for this room", http.StatusForbidden)
+		return
+	}
+
+	filePath := path.Join(s.app.HlsServer.WorkDir, roomId, recordingId, file)
+	switch path.Ext(file) {
+	case ".m3u8":
+		s.servePlaylist(w, filePath, token)
+	case ".ts", ".m4s", ".mp4":
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, filePath)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// servePlaylist will add the token to every uri of the playlist,
+// so that the player can fetch the segments without extra setup
+func (s *HlsService) servePlaylist(w http.ResponseWriter, filePath, token string) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		http.Error(w, "playlist not found", http.StatusNotFound)
+		return
+	}
+
+	query := "token=" + url.QueryEscape(token)
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		l := scanner.Text()
+		if l != "" && !strings.HasPrefix(l, "#") {
+			if strings.Contains(l, "?") {
+				l += "&" + query
+			} else {
+				l += "?" + query
+			}
+		}
+		out.WriteString(l)
+		out.WriteString("\n")
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(out.Bytes())
+}
@@ -0,0 +1,152 @@
+package httpservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	natsservice "github.com/retawsolit/WeMeet-recorder/pkg/services/nats"
+	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Provider gives the state of the recorder, implemented by the controller
+type Provider interface {
+	ActiveTasks() []*natsservice.TaskStatus
+	// CheckCapacity returns an error if new tasks won't be accepted
+	CheckCapacity() error
+}
+
+// HttpService is the local http server for health checks & inspection.
+//
+// /healthz: process is up
+// /readyz: nats connected, kv reachable, required binaries found & below max_limit
+// /tasks: the tasks in progress
+// /metrics: prometheus metrics
+type HttpService struct {
+	app      *config.AppConfig
+	ns       *natsservice.NatsService
+	provider Provider
+	server   *http.Server
+}
+
+type readyResponse struct {
+	Status bool              `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func New(app *config.AppConfig, provider Provider) *HttpService {
+	if app == nil {
+		app = config.GetConfig()
+	}
+	s := &HttpService{
+		app:      app,
+		ns:       natsservice.New(app),
+		provider: provider,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.HandleFunc("GET /tasks", s.handleTasks)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	s.server = &http.Server{
+		Addr:              app.HttpServer.ListenAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+// Run will block until the server was closed
+func (s *HttpService) Run() error {
+	log.Infoln(fmt.Sprintf("http server listening on %s", s.app.HttpServer.ListenAddress))
+
+	err := s.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *HttpService) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Errorln(err)
+	}
+}
+
+func (s *HttpService) handleHealth(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *HttpService) handleReady(w http.ResponseWriter, _ *http.Request) {
+	res := &readyResponse{
+		Status: true,
+		Checks: make(map[string]string),
+	}
+	check := func(name string, err error) {
+		if err != nil {
+			res.Status = false
+			res.Checks[name] = err.Error()
+			return
+		}
+		res.Checks[name] = "ok"
+	}
+
+	if s.app.NatsConn == nil || s.app.NatsConn.Status() != nats.CONNECTED {
+		check("nats", errors.New("nats is not connected"))
+		check("kv", errors.New("nats is not connected"))
+	} else {
+		check("nats", nil)
+		check("kv", s.ns.CheckRecorderKv())
+	}
+	check("binaries", s.checkBinaries())
+	check("capacity", s.provider.CheckCapacity())
+
+	status := http.StatusOK
+	if !res.Status {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, status, res)
+}
+
+func (s *HttpService) handleTasks(w http.ResponseWriter, _ *http.Request) {
+	tasks := s.provider.ActiveTasks()
+	if tasks == nil {
+		tasks = []*natsservice.TaskStatus{}
+	}
+	writeJson(w, http.StatusOK, tasks)
+}
+
+func (s *HttpService) checkBinaries() error {
+	bins := []string{"ffmpeg", "ffprobe", "pactl"}
+	if !s.app.Recorder.AudioOnly.Enabled {
+		bins = append(bins, "Xvfb")
+	}
+	for _, b := range bins {
+		if _, err := exec.LookPath(b); err != nil {
+			return fmt.Errorf("%s was not found", b)
+		}
+	}
+	_, err := utils.GetChromePath(s.app.Recorder.CustomChromePath)
+	return err
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorln(err)
+	}
+}
@@ -0,0 +1,76 @@
+package natsservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const publishEventTimeout = 5 * time.Second
+
+// RecorderEvent is the json envelope of every published event
+type RecorderEvent struct {
+	Id          string    `json:"id"`
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	RecorderId  string    `json:"recorder_id"`
+	RoomId      string    `json:"room_id"`
+	RoomTableId int64     `json:"room_table_id"`
+	RecordingId string    `json:"recording_id,omitempty"`
+	Task        string    `json:"task"`
+	// only for the notifications
+	Status *bool  `json:"status,omitempty"`
+	Msg    string `json:"msg,omitempty"`
+	// RecorderToWeMeet in protojson, as it was sent to the server
+	Notification json.RawMessage   `json:"notification,omitempty"`
+	Details      map[string]string `json:"details,omitempty"`
+}
+
+// CreateEventStream will make sure the stream of the events exists
+func (s *NatsService) CreateEventStream() error {
+	info := s.app.NatsInfo.Recorder.Events
+
+	_, err := s.js.CreateOrUpdateStream(s.ctx, jetstream.StreamConfig{
+		Name:      info.Stream,
+		Subjects:  []string{fmt.Sprintf("%s.>", info.SubjectPrefix)},
+		Replicas:  s.app.NatsInfo.NumReplicas,
+		Retention: jetstream.LimitsPolicy,
+		MaxAge:    time.Duration(info.MaxAge) * time.Hour,
+		// same id within this window will be stored only once
+		Duplicates: 2 * time.Minute,
+	})
+	return err
+}
+
+// PublishEvent publishes e to <subject_prefix>.<recorder id>.<room id>.<type>
+func (s *NatsService) PublishEvent(e *RecorderEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("%s.%s.%s.%s", s.app.NatsInfo.Recorder.Events.SubjectPrefix, subjectToken(e.RecorderId), subjectToken(e.RoomId), subjectToken(e.Type))
+	ctx, cancel := context.WithTimeout(s.ctx, publishEventTimeout)
+	defer cancel()
+
+	_, err = s.js.Publish(ctx, subject, data, jetstream.WithMsgID(e.Id))
+	return err
+}
+
+// subjectToken makes sure the value will be a single token of the subject
+func subjectToken(v string) string {
+	if v == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, v)
+}
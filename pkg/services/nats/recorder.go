@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/nats-io/nats.go/jetstream"
+	"github.com/retawsolit/WeMeet-recorder/pkg/metrics"
 	"github.com/retawsolit/wemeet-protocol/wemeet"
 	log "github.com/sirupsen/logrus"
 )
@@ -61,6 +62,22 @@ func (s *NatsService) UpdateLastPing() error {
 	return nil
 }
 
+// UpdateMaxLimit will change the advertised capacity of this recorder,
+// 0 will make the server skip this recorder for new tasks
+func (s *NatsService) UpdateMaxLimit(limit uint64) error {
+	bucket := fmt.Sprintf(RecorderKvBucket, s.app.NatsInfo.Recorder.RecorderInfoKv, s.app.Recorder.Id)
+	kv, err := s.js.KeyValue(s.ctx, bucket)
+	switch {
+	case errors.Is(err, jetstream.ErrBucketNotFound):
+		return errors.New("this recorder was not found")
+	case err != nil:
+		return err
+	}
+
+	_, err = kv.PutString(s.ctx, fmt.Sprintf("%d", wemeet.RecorderInfoKeys_RECORDER_INFO_MAX_LIMIT), fmt.Sprintf("%d", limit))
+	return err
+}
+
 func (s *NatsService) UpdateCurrentProgress(increment bool) error {
 	bucket := fmt.Sprintf(RecorderKvBucket, s.app.NatsInfo.Recorder.RecorderInfoKv, s.app.Recorder.Id)
 	kv, err := s.js.KeyValue(s.ctx, bucket)
@@ -101,6 +118,7 @@ func (s *NatsService) UpdateCurrentProgress(increment bool) error {
 		var apiErr *jetstream.APIError
 		if errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence {
 			// This is the expected conflict error, wait a bit and retry.
+			metrics.KvUpdateRetries.Inc()
 			time.Sleep(retryUpdateBackoff)
 			continue
 		}
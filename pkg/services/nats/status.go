@@ -0,0 +1,129 @@
+package natsservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/retawsolit/WeMeet-recorder/pkg/recorder"
+	"github.com/retawsolit/WeMeet-recorder/pkg/utils"
+)
+
+const (
+	// RecorderStatusKey stores RecorderStatus in json
+	RecorderStatusKey = "status"
+	// RecorderTaskKeyPrefix + task id stores TaskStatus in json
+	RecorderTaskKeyPrefix = "task."
+)
+
+// RecorderStatus is the detailed status of this recorder
+type RecorderStatus struct {
+	RecorderId    string               `json:"recorder_id"`
+	Version       string               `json:"version"`
+	Runtime       string               `json:"runtime"`
+	ChromeVersion string               `json:"chrome_version"`
+	FfmpegVersion string               `json:"ffmpeg_version"`
+	MaxLimit      uint64               `json:"max_limit"`
+	ActiveTasks   int                  `json:"active_tasks"`
+	Draining      bool                 `json:"draining"`
+	Host          *utils.HostResources `json:"host,omitempty"`
+	BootedAt      time.Time            `json:"booted_at"`
+	UpdatedAt     time.Time            `json:"updated_at"`
+}
+
+// TaskStatus is the status of a single active task
+type TaskStatus struct {
+	Id          string `json:"id"`
+	RoomId      string `json:"room_id"`
+	RoomTableId int64  `json:"room_table_id"`
+	RecordingId string `json:"recording_id"`
+	Task        string `json:"task"`
+	// empty until the output was started
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	OutputBytes    int64      `json:"output_bytes"`
+	FfmpegRestarts int        `json:"ffmpeg_restarts"`
+	AudioOnly      bool       `json:"audio_only"`
+	// latest progress of ffmpeg
+	Progress  *recorder.FfmpegProgress `json:"progress,omitempty"`
+	UpdatedAt time.Time                `json:"updated_at"`
+}
+
+func (s *NatsService) recorderKv() (jetstream.KeyValue, error) {
+	bucket := fmt.Sprintf(RecorderKvBucket, s.app.NatsInfo.Recorder.RecorderInfoKv, s.app.Recorder.Id)
+	kv, err := s.js.KeyValue(s.ctx, bucket)
+	switch {
+	case errors.Is(err, jetstream.ErrBucketNotFound):
+		return nil, errors.New("this recorder was not found")
+	case err != nil:
+		return nil, err
+	}
+	return kv, nil
+}
+
+// CheckRecorderKv returns an error if the bucket of this recorder isn't reachable
+func (s *NatsService) CheckRecorderKv() error {
+	_, err := s.recorderKv()
+	return err
+}
+
+func (s *NatsService) UpdateRecorderStatus(status *RecorderStatus) error {
+	kv, err := s.recorderKv()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(s.ctx, RecorderStatusKey, data)
+	return err
+}
+
+func (s *NatsService) UpdateTaskStatus(status *TaskStatus) error {
+	kv, err := s.recorderKv()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(s.ctx, RecorderTaskKeyPrefix+status.Id, data)
+	return err
+}
+
+func (s *NatsService) DeleteTaskStatus(id string) error {
+	kv, err := s.recorderKv()
+	if err != nil {
+		return err
+	}
+	err = kv.Delete(s.ctx, RecorderTaskKeyPrefix+id)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil
+	}
+	return err
+}
+
+// TaskStatusIds returns the ids of all the tasks found in the bucket
+func (s *NatsService) TaskStatusIds() ([]string, error) {
+	kv, err := s.recorderKv()
+	if err != nil {
+		return nil, err
+	}
+	lister, err := kv.ListKeysFiltered(s.ctx, RecorderTaskKeyPrefix+">")
+	if errors.Is(err, jetstream.ErrNoKeysFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer lister.Stop()
+
+	var ids []string
+	for k := range lister.Keys() {
+		ids = append(ids, strings.TrimPrefix(k, RecorderTaskKeyPrefix))
+	}
+	return ids, nil
+}
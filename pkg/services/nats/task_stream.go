@@ -0,0 +1,41 @@
+package natsservice
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// CreateTaskConsumer will make sure the stream of recorder_channel exists
+// and returns the durable consumer of this recorder
+func (s *NatsService) CreateTaskConsumer() (jetstream.Consumer, error) {
+	info := s.app.NatsInfo.Recorder.TaskStream
+
+	stream, err := s.js.CreateOrUpdateStream(s.ctx, jetstream.StreamConfig{
+		Name:     info.Name,
+		Subjects: []string{s.app.NatsInfo.Recorder.RecorderChannel},
+		Replicas: s.app.NatsInfo.NumReplicas,
+		// every recorder has its own consumer, message will be removed once all of them have acked
+		Retention: jetstream.InterestPolicy,
+		MaxAge:    time.Hour,
+		// otherwise the stream will reply with PubAck to the request of the server
+		// and recorder's response won't reach there
+		NoAck: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stream.CreateOrUpdateConsumer(s.ctx, jetstream.ConsumerConfig{
+		Durable:       fmt.Sprintf("recorder-%s", s.app.Recorder.Id),
+		FilterSubject: s.app.NatsInfo.Recorder.RecorderChannel,
+		// tasks before the first start of this recorder aren't for us
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       time.Duration(info.AckWait) * time.Second,
+		MaxDeliver:    info.MaxDeliver,
+		// remove the consumer of a recorder which doesn't exist anymore
+		InactiveThreshold: 24 * time.Hour,
+	})
+}
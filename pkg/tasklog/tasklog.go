@@ -0,0 +1,169 @@
+package tasklog
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// correlation fields of every log entry of a task
+const (
+	FieldRecordingId = "recording_id"
+	FieldRoomId      = "room_id"
+	FieldRoomTableId = "room_table_id"
+	FieldTask        = "task"
+	FieldRecorderId  = "recorder_id"
+)
+
+// Fields returns the correlation fields of req
+func Fields(req *wemeet.WeMeetToRecorder) log.Fields {
+	return log.Fields{
+		FieldRecordingId: req.GetRecordingId(),
+		FieldRoomId:      req.GetRoomId(),
+		FieldRoomTableId: req.GetRoomTableId(),
+		FieldTask:        req.GetTask().String(),
+		FieldRecorderId:  req.GetRecorderId(),
+	}
+}
+
+// Entry returns a logger which will add the correlation fields of req
+func Entry(req *wemeet.WeMeetToRecorder) *log.Entry {
+	return log.WithFields(Fields(req))
+}
+
+// fileHook writes the entries of a task to its own file as well
+type fileHook struct {
+	dir     string
+	maxSize int
+	maxAge  time.Duration
+	files   map[string]*lumberjack.Logger
+	sync.Mutex
+}
+
+var hook *fileHook
+
+// EnableFiles will write the entries of every opened task to its own file.
+// If dir is empty then the file will be placed in the output dir of the task,
+// otherwise files older than maxAge days will be removed from dir.
+func EnableFiles(dir string, maxSize, maxAge int) {
+	if hook != nil {
+		return
+	}
+	hook = &fileHook{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  time.Duration(maxAge) * time.Hour * 24,
+		files:   make(map[string]*lumberjack.Logger),
+	}
+	log.AddHook(hook)
+}
+
+// Open starts the file of req, outputDir is where the recording will be written,
+// can be empty if the task has no file. It's safe to call it more than once.
+func Open(req *wemeet.WeMeetToRecorder, outputDir string) {
+	if hook == nil || req.GetRecordingId() == "" {
+		return
+	}
+	dir := hook.dir
+	if dir == "" {
+		dir = outputDir
+	}
+	if dir == "" {
+		return
+	}
+
+	key := fileKey(req.GetRecordingId(), req.GetTask().String())
+	hook.Lock()
+	defer hook.Unlock()
+	if _, ok := hook.files[key]; ok {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Errorln(fmt.Sprintf("failed to create dir for the log of recordingId: %s, error: %s", req.GetRecordingId(), err.Error()))
+		return
+	}
+	if hook.dir != "" {
+		hook.prune()
+	}
+
+	name := req.GetRecordingId() + ".log"
+	if req.GetTask() != wemeet.RecordingTasks_START_RECORDING {
+		// e.g. rtmp of the same recording
+		name = fmt.Sprintf("%s_%s.log", req.GetRecordingId(), strings.ToLower(req.GetTask().String()))
+	}
+	hook.files[key] = &lumberjack.Logger{
+		Filename: path.Join(dir, name),
+		MaxSize:  hook.maxSize,
+	}
+}
+
+// Close closes the file of req, the file will be kept
+func Close(req *wemeet.WeMeetToRecorder) {
+	if hook == nil {
+		return
+	}
+	key := fileKey(req.GetRecordingId(), req.GetTask().String())
+	hook.Lock()
+	f, ok := hook.files[key]
+	delete(hook.files, key)
+	hook.Unlock()
+	if ok {
+		_ = f.Close()
+	}
+}
+
+func (h *fileHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *fileHook) Fire(e *log.Entry) error {
+	recordingId, _ := e.Data[FieldRecordingId].(string)
+	task, _ := e.Data[FieldTask].(string)
+	if recordingId == "" {
+		return nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	f, ok := h.files[fileKey(recordingId, task)]
+	if !ok {
+		return nil
+	}
+	line, err := e.Logger.Formatter.Format(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	return err
+}
+
+// prune removes the old files from dir, lock must be held
+func (h *fileHook) prune() {
+	if h.maxAge <= 0 {
+		return
+	}
+	files, err := os.ReadDir(h.dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".log") {
+			continue
+		}
+		info, err := f.Info()
+		if err == nil && time.Since(info.ModTime()) > h.maxAge {
+			_ = os.Remove(path.Join(h.dir, f.Name()))
+		}
+	}
+}
+
+func fileKey(recordingId, task string) string {
+	return recordingId + "/" + task
+}
@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/retawsolit/WeMeet-recorder/pkg/config"
+	"github.com/retawsolit/WeMeet-recorder/version"
+	"github.com/retawsolit/wemeet-protocol/wemeet"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/retawsolit/WeMeet-recorder"
+
+// Init will export the spans to the otlp collector if tracing is enabled,
+// otherwise all the spans will be no-op. Returned func must be called before exit.
+func Init(app *config.AppConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !app.Tracing.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(app.Tracing.Endpoint),
+	}
+	if app.Tracing.Insecure == nil || *app.Tracing.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if app.Tracing.UrlPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(app.Tracing.UrlPath))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(app.Tracing.ServiceName),
+		semconv.ServiceVersion(version.Version),
+		semconv.ServiceInstanceID(app.Recorder.Id),
+	)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(app.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// Start a new span, ctx can be nil
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// TaskAttributes describe the task of a span
+func TaskAttributes(req *wemeet.WeMeetToRecorder) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("recorder.task", req.Task.String()),
+		attribute.Int64("recorder.room_table_id", req.GetRoomTableId()),
+		attribute.String("recorder.room_id", req.GetRoomId()),
+		attribute.String("recorder.recording_id", req.GetRecordingId()),
+	}
+}
+
+// End the span, with error status if err isn't nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// FromNatsHeader returns the context propagated by the publisher, if any
+func FromNatsHeader(header nats.Header) context.Context {
+	ctx := context.Background()
+	if len(header) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, natsHeaderCarrier(header))
+}
+
+// natsHeaderCarrier is case-insensitive, nats keeps the keys as they were published
+type natsHeaderCarrier nats.Header
+
+func (c natsHeaderCarrier) Get(key string) string {
+	for k, v := range c {
+		if strings.EqualFold(k, key) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func (c natsHeaderCarrier) Set(key, value string) {
+	c[key] = []string{value}
+}
+
+func (c natsHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
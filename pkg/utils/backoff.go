@@ -0,0 +1,16 @@
+package utils
+
+import "time"
+
+// Backoff returns the wait time before the given attempt (starting from 1),
+// base will be doubled after every attempt up to max
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	backoff := base
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
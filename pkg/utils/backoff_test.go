@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 0, want: 2 * time.Second},
+		{attempt: 1, want: 2 * time.Second},
+		{attempt: 2, want: 4 * time.Second},
+		{attempt: 4, want: 16 * time.Second},
+		{attempt: 5, want: 30 * time.Second},
+		{attempt: 100, want: 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := Backoff(tt.attempt, 2*time.Second, 30*time.Second); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
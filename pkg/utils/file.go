@@ -0,0 +1,13 @@
+package utils
+
+import "os"
+
+// WriteFileAtomic writes data in a temporary file and renames it to file,
+// so a crash will never leave a partial file
+func WriteFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// HostResources is a snapshot of the resources available on this node
+type HostResources struct {
+	NumCpu        int     `json:"num_cpu"`
+	LoadAvg1      float64 `json:"load_avg_1"`
+	LoadPerCpu    float64 `json:"load_per_cpu"`
+	MemTotalMb    uint64  `json:"mem_total_mb"`
+	MemFreeMb     uint64  `json:"mem_free_mb"`
+	DiskTotalMb   uint64  `json:"disk_total_mb"`
+	DiskFreeMb    uint64  `json:"disk_free_mb"`
+	DiskCheckPath string  `json:"disk_check_path"`
+}
+
+// GetHostResources reads load average and memory from /proc
+// and free disk space of the filesystem that holds diskPath
+func GetHostResources(diskPath string) (*HostResources, error) {
+	res := &HostResources{
+		NumCpu:        runtime.NumCPU(),
+		DiskCheckPath: diskPath,
+	}
+
+	load, err := readLoadAvg()
+	if err != nil {
+		return nil, err
+	}
+	res.LoadAvg1 = load
+	res.LoadPerCpu = load / float64(res.NumCpu)
+
+	total, available, err := readMemInfo()
+	if err != nil {
+		return nil, err
+	}
+	res.MemTotalMb = total / 1024
+	res.MemFreeMb = available / 1024
+
+	if diskPath != "" {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(diskPath, &st); err != nil {
+			return nil, fmt.Errorf("statfs %s: %w", diskPath, err)
+		}
+		res.DiskTotalMb = st.Blocks * uint64(st.Bsize) / 1024 / 1024
+		res.DiskFreeMb = st.Bavail * uint64(st.Bsize) / 1024 / 1024
+	}
+
+	return res, nil
+}
+
+func readLoadAvg() (float64, error) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/loadavg format")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// readMemInfo returns MemTotal and MemAvailable in kB
+func readMemInfo() (uint64, uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var total, available uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = v
+		case "MemAvailable:":
+			available = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	return total, available, nil
+}
@@ -2,20 +2,36 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"net/http"
+	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/retawsolit/wemeet-protocol/wemeet"
 	"google.golang.org/protobuf/proto"
 )
 
+// notifyTimeout is the max time of a single attempt
+const notifyTimeout = 30 * time.Second
+
+// notifyHttpClient is shared by all the calls, so that its connections can be reused
+var notifyHttpClient = func() *http.Client {
+	// pooled client of retryablehttp
+	c := retryablehttp.NewClient().HTTPClient
+	c.Timeout = notifyTimeout
+	return c
+}()
+
 // NotifyToWeMeet will use retryablehttp to make request
-func NotifyToWeMeet(host, apiKey, apiSecret string, req *wemeet.RecorderToWeMeet, retryMax *uint) (int, error) {
+func NotifyToWeMeet(ctx context.Context, host, apiKey, apiSecret string, req *wemeet.RecorderToWeMeet, retryMax *uint) (int, error) {
 	client := retryablehttp.NewClient()
 	client.Logger = nil
+	client.HTTPClient = notifyHttpClient
 	if retryMax != nil {
 		client.RetryMax = int(*retryMax)
 	}
@@ -27,7 +43,7 @@ func NotifyToWeMeet(host, apiKey, apiSecret string, req *wemeet.RecorderToWeMeet
 		return 0, err
 	}
 	link := fmt.Sprintf("%s/auth/recorder/notify", host)
-	r, err = retryablehttp.NewRequest("POST", link, bytes.NewReader(body))
+	r, err = retryablehttp.NewRequestWithContext(ctx, "POST", link, bytes.NewReader(body))
 	if err != nil {
 		return 0, err
 	}
@@ -44,6 +60,9 @@ func NotifyToWeMeet(host, apiKey, apiSecret string, req *wemeet.RecorderToWeMeet
 	if err != nil {
 		return 0, err
 	}
+	defer resp.Body.Close()
+	// so that the connection can be reused
+	_, _ = io.Copy(io.Discard, resp.Body)
 
 	return resp.StatusCode, nil
 }
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// chrome binaries in the same order chromedp will look for them
+var chromeBinaries = []string{"google-chrome", "google-chrome-stable", "chromium", "chromium-browser", "headless-shell"}
+
+// GetChromePath returns the path of the chrome which will be used by the recorder
+func GetChromePath(customPath *string) (string, error) {
+	if customPath != nil && *customPath != "" {
+		return exec.LookPath(*customPath)
+	}
+	for _, b := range chromeBinaries {
+		if p, err := exec.LookPath(b); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("chrome was not found, tried: %s", strings.Join(chromeBinaries, ", "))
+}
+
+// GetChromeVersion returns the version of the chrome which will be used by the recorder,
+// empty if it wasn't found
+func GetChromeVersion(customPath *string) string {
+	p, err := GetChromePath(customPath)
+	if err != nil {
+		return ""
+	}
+	return getBinaryVersion(p, "--version")
+}
+
+// GetFfmpegVersion returns the first line of ffmpeg -version
+func GetFfmpegVersion() string {
+	return getBinaryVersion("ffmpeg", "-version")
+}
+
+func getBinaryVersion(bin string, args ...string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, bin, args...).Output()
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line)
+}